@@ -1,23 +1,51 @@
 package gnet
 
 import (
+	"net"
+
 	"golang.org/x/sys/unix"
+	"golang_project_note/gnet/internal/netpoll"
 )
 
+// accept的连接使用所属listener的codec，监听0.0.0.0、::时本地地址是连接实际使用的地址
+func (svr *server) newAcceptedConn(fd int, el *eventloop, sa unix.Sockaddr, ln *listener) *conn {
+	c := newTCPConn(fd, el, sa)
+	c.localAddr = ln.lnaddr
+	c.sockopts = ln.sockopts
+	if _, ok := ln.lnaddr.(*net.TCPAddr); ok {
+		if local, err := unix.Getsockname(fd); err == nil {
+			c.localAddr = netpoll.SockaddrToTCPOrUnixAddr(local)
+		}
+	}
+	if ln.codec != nil {
+		c.codec = ln.codec
+	}
+	svr.acceptTLS(c)
+	return c
+}
+
 func (svr *server) acceptNewConnection(fd int) error {
-	nfd, sa, err := unix.Accept(fd)
+	nfd, sa, err := svr.mainLoop.poller.Accept(fd)
 	if err != nil {
 		if err == unix.EAGAIN {
 			return nil
 		}
+		// 开始drain时listener已经关闭，不再监听它，main reactor要继续运行到stop()
+		if svr.inShutdown() {
+			_ = svr.mainLoop.poller.Delete(fd)
+			return nil
+		}
 		return err
 	}
+	if svr.inShutdown() {
+		return unix.Close(nfd)
+	}
 	if err := unix.SetNonblock(nfd, true); err != nil {
 		return err
 	}
 
 	el := svr.subEventLoopSet.next(nfd)
-	c := newTCPConn(nfd, el, sa)
+	c := svr.newAcceptedConn(nfd, el, sa, svr.listener(fd))
 	_ = el.poller.Trigger(func() (err error) {
 		if err = el.poller.AddRead(nfd); err != nil {
 			return
@@ -0,0 +1,221 @@
+package gnet
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"golang_project_note/gnet/internal/netpoll"
+)
+
+// Client通过Dial创建的连接和server accept的连接一样由eventloop处理，使用同样的EventHandler和ICodec
+type Client struct {
+	engine *Engine
+}
+
+// NewClient启动只用于Dial的eventloop，Options中和监听有关的选项不会生效，设置了TLSConfig时Dial的连接作为TLS客户端，
+// 握手完成后才调用OnOpened。如果需要和server的连接在同一组eventloop上，使用Engine.Dial
+func NewClient(eventHandler EventHandler, opts ...Option) (*Client, error) {
+	options := loadOptions(opts...)
+	if options.Logger != nil {
+		defaultLogger = options.Logger
+	}
+	if err := options.SocketOptions.validate(); err != nil {
+		return nil, err
+	}
+	// 没有监听的socket，只启动处理连接的eventloop
+	svr, err := startServer(eventHandler, nil, options)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{engine: &Engine{svr: svr}}, nil
+}
+
+// Dial见Engine.Dial
+func (cli *Client) Dial(network, addr string) (Conn, error) {
+	return cli.engine.Dial(network, addr)
+}
+
+// Done在Client完全停止后关闭
+func (cli *Client) Done() <-chan struct{} {
+	return cli.engine.Done()
+}
+
+// Stop和Engine.Stop一样，等待所有连接的outboundBuffer发送完毕，ctx结束时强制关闭
+func (cli *Client) Stop(ctx context.Context) error {
+	return cli.engine.Stop(ctx)
+}
+
+// Dial发起非阻塞的connect后立即返回，连接建立后在所属的eventloop中调用OnOpened，
+// 连接失败时调用OnClosed并传入错误。连接建立之前AsyncWrite、AsyncWritev的数据会先缓存，
+// 建立后排在OnOpened返回的数据之前发送。支持tcp、tcp4、tcp6和unix，连接不使用Options.TLSConfig
+func (e *Engine) Dial(network, addr string) (Conn, error) {
+	return e.svr.dial(network, addr)
+}
+
+// Register接管一个已经建立的TCP或unix连接，之后由loop处理（nil表示按负载均衡选择），nc会被关闭，
+// 只使用复制出来的fd。返回的Conn在所属的eventloop中调用OnOpened之后才开始读写
+func (e *Engine) Register(nc net.Conn, loop EventLoop) (Conn, error) {
+	return e.svr.register(nc, loop)
+}
+
+func (svr *server) dial(network, addr string) (Conn, error) {
+	if svr.inShutdown() {
+		return nil, ErrServerInShutdown
+	}
+	var (
+		raddr net.Addr
+		err   error
+	)
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		var tcpAddr *net.TCPAddr
+		if tcpAddr, err = net.ResolveTCPAddr(network, addr); err != nil {
+			return nil, err
+		}
+		// 和net.Dial一样，没有指定IP时连接本机
+		if tcpAddr.IP == nil {
+			if network == "tcp6" {
+				tcpAddr.IP = net.IPv6loopback
+			} else {
+				tcpAddr.IP = net.IPv4(127, 0, 0, 1)
+			}
+		}
+		raddr = tcpAddr
+	case "unix":
+		if raddr, err = net.ResolveUnixAddr(network, addr); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnsupportedProtocol
+	}
+	domain, sa, err := netpoll.TCPOrUnixAddrToSockaddr(raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(domain, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	unix.CloseOnExec(fd)
+	if err = unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	if err = unix.Connect(fd, sa); err != nil && err != unix.EINPROGRESS {
+		_ = unix.Close(fd)
+		return nil, os.NewSyscallError("connect", err)
+	}
+
+	el := svr.subEventLoopSet.next(fd)
+	c := newTCPConn(fd, el, sa)
+	c.connecting = true
+	c.sockopts = &svr.opts.SocketOptions
+	svr.dialTLS(c, network, addr)
+	// 连接完成时可写，失败时出错，两种情况都由loopConnect处理
+	svr.adopt(el, c, el.poller.AddWrite)
+	return c, nil
+}
+
+func (svr *server) register(nc net.Conn, loop EventLoop) (Conn, error) {
+	if svr.inShutdown() {
+		return nil, ErrServerInShutdown
+	}
+	switch nc.(type) {
+	case *net.TCPConn, *net.UnixConn:
+	default:
+		return nil, ErrUnsupportedProtocol
+	}
+	rc, err := nc.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		fd     int
+		dupErr error
+	)
+	if err = rc.Control(func(s uintptr) {
+		fd, dupErr = unix.Dup(int(s))
+	}); err != nil {
+		return nil, err
+	}
+	if dupErr != nil {
+		return nil, os.NewSyscallError("dup", dupErr)
+	}
+	// 之后只有复制出来的fd属于gnet
+	localAddr, remoteAddr := nc.LocalAddr(), nc.RemoteAddr()
+	_ = nc.Close()
+	unix.CloseOnExec(fd)
+	if err = unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+
+	var el *eventloop
+	if loop == nil {
+		el = svr.subEventLoopSet.next(fd)
+	} else if l, ok := loop.(*eventloop); ok && l.svr == svr {
+		el = l
+	} else {
+		_ = unix.Close(fd)
+		return nil, ErrInvalidEventLoop
+	}
+	sa, _ := unix.Getpeername(fd)
+	c := newTCPConn(fd, el, sa)
+	c.localAddr, c.remoteAddr = localAddr, remoteAddr
+	svr.adopt(el, c, el.poller.AddRead)
+	return c, nil
+}
+
+// 在el中注册fd并加入连接，Dial的连接等待connect完成，Register的连接直接打开
+func (svr *server) adopt(el *eventloop, c *conn, add func(fd int) error) {
+	_ = el.poller.Trigger(func() error {
+		if err := add(c.fd); err != nil {
+			_ = unix.Close(c.fd)
+			c.connecting = false
+			if c.tls != nil {
+				c.tls.close()
+			}
+			switch el.eventHandler.OnClosed(c, err) {
+			case Shutdown:
+				return errServerShutdown
+			}
+			c.releaseTCP()
+			return nil
+		}
+		el.connections[c.fd] = c
+		el.calibrateCallback(el, 1)
+		if c.connecting {
+			return nil
+		}
+		return el.loopOpen(c)
+	})
+}
+
+// 非阻塞connect完成（可写）或者失败（出错）时调用
+func (el *eventloop) loopConnect(c *conn) error {
+	c.connecting = false
+	errno, err := unix.GetsockoptInt(c.fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err == nil && errno != 0 {
+		err = unix.Errno(errno)
+	}
+	if err != nil {
+		return el.loopCloseConn(c, os.NewSyscallError("connect", err))
+	}
+	if sa, err := unix.Getsockname(c.fd); err == nil {
+		c.localAddr = netpoll.SockaddrToTCPOrUnixAddr(sa)
+	}
+	// AddWrite只监听了可写事件
+	el.modEvents(c)
+	if err = el.loopOpen(c); err != nil || !c.opened {
+		return err
+	}
+	// socket已经可写，直接发送连接建立之前缓存的数据，io_uring模式下也不会再有可写通知
+	if c.pendingOutput() {
+		return el.loopWrite(c)
+	}
+	return nil
+}
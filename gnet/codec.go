@@ -3,38 +3,64 @@ package gnet
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 )
 
 // CRLFByte represents a byte of CRLF.
 var CRLFByte = byte('\n')
 
+// CRLF is the line break of LineBasedFrameCodec in CRLF mode.
+var CRLF = []byte("\r\n")
+
+const maxInt = int(^uint(0) >> 1)
+
 type (
 	// ICodec is the interface of gnet codec.
 	ICodec interface {
 		// Encode encodes frames upon server responses into TCP stream.
 		Encode(c Conn, buf []byte) ([]byte, error)
 		// Decode decodes frames from TCP stream via specific implementation.
+		// The returned frame may refer to the inbound buffer of c and is only valid until the next Decode.
 		Decode(c Conn) ([]byte, error)
 	}
 
 	// BuiltInFrameCodec is the built-in codec which will be assigned to gnet server when customized codec is not set up.
 	BuiltInFrameCodec struct {
+		// MaxFrameLength limits the bytes passed to React at once, longer data is split into several frames.
+		// Zero means no limit.
+		MaxFrameLength int
 	}
 
 	// LineBasedFrameCodec encodes/decodes line-separated frames into/from TCP stream.
 	LineBasedFrameCodec struct {
+		// MaxFrameLength is the maximum length of a line, excluding the line break.
+		// Zero means no limit.
+		MaxFrameLength int
+		// CRLF makes Encode end lines with "\r\n" and Decode split lines only on "\r\n", so that no '\r' is left
+		// at the end of frames from telnet-style clients; a bare '\n' stays in the frame.
+		CRLF bool
+		// KeepDelimiter keeps the line break at the end of decoded frames.
+		KeepDelimiter bool
 	}
 
 	// DelimiterBasedFrameCodec encodes/decodes specific-delimiter-separated frames into/from TCP stream.
 	DelimiterBasedFrameCodec struct {
-		delimiter byte
+		// 按顺序的候选分隔符，Encode使用第一个
+		delimiters [][]byte
+		// 最长的分隔符的长度，继续查找时要回退maxDelimiter-1个字节
+		maxDelimiter int
+		// MaxFrameLength is the maximum length of a frame, excluding the delimiter.
+		// Zero means no limit.
+		MaxFrameLength int
+		// KeepDelimiter keeps the delimiter at the end of decoded frames.
+		KeepDelimiter bool
 	}
 
 	// FixedLengthFrameCodec encodes/decodes fixed-length-separated frames into/from TCP stream.
 	FixedLengthFrameCodec struct {
 		frameLength int
+		// MaxFrameLength rejects a frameLength larger than it. Zero means no limit.
+		MaxFrameLength int
 	}
 
 	// LengthFieldBasedFrameCodec is the refactoring from
@@ -44,6 +70,14 @@ type (
 		encoderConfig EncoderConfig
 		decoderConfig DecoderConfig
 	}
+
+	// VarintLengthFrameCodec encodes/decodes frames prefixed with their length as an unsigned varint into/from
+	// TCP stream, the same framing as protobuf delimited messages.
+	VarintLengthFrameCodec struct {
+		// MaxFrameLength is the maximum length of a frame, excluding the varint prefix. Decode checks it as soon as
+		// the prefix is received, and Encode rejects longer frames. Zero means no limit.
+		MaxFrameLength int
+	}
 )
 
 // Encode ...
@@ -57,65 +91,178 @@ func (cc *BuiltInFrameCodec) Decode(c Conn) ([]byte, error) {
 	if len(buf) == 0 {
 		return nil, nil
 	}
+	// 没有帧边界，超过MaxFrameLength时拆成多帧，不算违规
+	if cc.MaxFrameLength > 0 && len(buf) > cc.MaxFrameLength {
+		c.ShiftN(cc.MaxFrameLength)
+		return buf[:cc.MaxFrameLength], nil
+	}
 	c.ResetBuffer()
 	return buf, nil
 }
 
 // Encode ...
 func (cc *LineBasedFrameCodec) Encode(c Conn, buf []byte) ([]byte, error) {
+	if cc.CRLF {
+		return append(buf, CRLF...), nil
+	}
 	return append(buf, CRLFByte), nil
 }
 
 // Decode ...
 func (cc *LineBasedFrameCodec) Decode(c Conn) ([]byte, error) {
+	delimiter := []byte{CRLFByte}
+	if cc.CRLF {
+		delimiter = CRLF
+	}
 	buf := c.Read()
-	idx := bytes.IndexByte(buf, CRLFByte)
+	from := scanFrom(c, len(buf))
+	idx := bytes.Index(buf[from:], delimiter)
+	if idx != -1 {
+		idx += from
+	}
+	if err := checkDelimitedFrame(len(buf), idx, len(delimiter), cc.MaxFrameLength); err != nil {
+		return nil, err
+	}
 	if idx == -1 {
-		return nil, errCRLFNotFound
+		// CRLF模式下\r\n可能跨过已经查找过的部分的末尾
+		setScanFrom(c, len(buf)-len(delimiter)+1)
+		return nil, ErrCRLFNotFound
+	}
+	end := idx + len(delimiter)
+	c.ShiftN(end)
+	if cc.KeepDelimiter {
+		return buf[:end], nil
 	}
-	c.ShiftN(idx + 1)
 	return buf[:idx], nil
 }
 
+// 分隔符类的codec在conn上记录已经查找过、没有分隔符的位置，下次Decode从这里继续，不再从头查找整个缓冲区。
+// ShiftN、ResetBuffer之后从头开始
+func scanFrom(c Conn, buffered int) int {
+	if c, ok := c.(*conn); ok && c.scanned <= buffered {
+		return c.scanned
+	}
+	return 0
+}
+
+func setScanFrom(c Conn, n int) {
+	if c, ok := c.(*conn); ok {
+		if n < 0 {
+			n = 0
+		}
+		c.scanned = n
+	}
+}
+
+// 找到了分隔符时检查帧的长度；还没找到时已经缓存的数据都属于同一帧，超过限制后不必再等分隔符。
+// 多字节的分隔符可能只收到了开头的delim-1个字节，它们不算在帧里
+func checkDelimitedFrame(buffered, idx, delim, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	if idx == -1 && delim > 1 {
+		buffered -= delim - 1
+	}
+	if idx == -1 && buffered > max {
+		return &FrameTooLargeError{Length: buffered, Limit: max}
+	}
+	if idx > max {
+		return &FrameTooLargeError{Length: idx, Limit: max}
+	}
+	return nil
+}
+
 // NewDelimiterBasedFrameCodec instantiates and returns a codec with a specific delimiter.
 func NewDelimiterBasedFrameCodec(delimiter byte) *DelimiterBasedFrameCodec {
-	return &DelimiterBasedFrameCodec{delimiter}
+	return NewMultiDelimiterBasedFrameCodec([]byte{delimiter})
+}
+
+// NewMultiDelimiterBasedFrameCodec instantiates and returns a codec with byte-sequence delimiters, a frame ends at
+// the earliest occurrence of any of them like Netty's DelimiterBasedFrameDecoder, and Encode appends the first one.
+// Empty delimiters are ignored.
+func NewMultiDelimiterBasedFrameCodec(delimiters ...[]byte) *DelimiterBasedFrameCodec {
+	cc := &DelimiterBasedFrameCodec{}
+	for _, d := range delimiters {
+		if len(d) == 0 {
+			continue
+		}
+		cc.delimiters = append(cc.delimiters, append([]byte(nil), d...))
+		if len(d) > cc.maxDelimiter {
+			cc.maxDelimiter = len(d)
+		}
+	}
+	return cc
 }
 
 // Encode ...
 func (cc *DelimiterBasedFrameCodec) Encode(c Conn, buf []byte) ([]byte, error) {
-	return append(buf, cc.delimiter), nil
+	if len(cc.delimiters) == 0 {
+		return buf, nil
+	}
+	return append(buf, cc.delimiters[0]...), nil
 }
 
 // Decode ...
 func (cc *DelimiterBasedFrameCodec) Decode(c Conn) ([]byte, error) {
 	buf := c.Read()
-	idx := bytes.IndexByte(buf, cc.delimiter)
+	from := scanFrom(c, len(buf))
+	idx, n := cc.index(buf[from:])
+	if idx != -1 {
+		idx += from
+	}
+	if err := checkDelimitedFrame(len(buf), idx, cc.maxDelimiter, cc.MaxFrameLength); err != nil {
+		return nil, err
+	}
 	if idx == -1 {
-		return nil, errDelimiterNotFound
+		// 分隔符可能跨过已经查找过的部分的末尾
+		setScanFrom(c, len(buf)-cc.maxDelimiter+1)
+		return nil, ErrDelimiterNotFound
+	}
+	c.ShiftN(idx + n)
+	if cc.KeepDelimiter {
+		return buf[:idx+n], nil
 	}
-	c.ShiftN(idx + 1)
 	return buf[:idx], nil
 }
 
+// 最早出现的分隔符的位置和长度，在同一位置时取靠前的分隔符
+func (cc *DelimiterBasedFrameCodec) index(buf []byte) (idx, n int) {
+	idx = -1
+	for _, d := range cc.delimiters {
+		// 只需要找比已经找到的位置更早的
+		end := len(buf)
+		if idx != -1 && idx+len(d) < end {
+			end = idx + len(d)
+		}
+		if i := bytes.Index(buf[:end], d); i != -1 && (idx == -1 || i < idx) {
+			idx, n = i, len(d)
+		}
+	}
+	return
+}
+
 // NewFixedLengthFrameCodec instantiates and returns a codec with fixed length.
 func NewFixedLengthFrameCodec(frameLength int) *FixedLengthFrameCodec {
-	return &FixedLengthFrameCodec{frameLength}
+	return &FixedLengthFrameCodec{frameLength: frameLength}
 }
 
 // Encode ...
 func (cc *FixedLengthFrameCodec) Encode(c Conn, buf []byte) ([]byte, error) {
 	if len(buf)%cc.frameLength != 0 {
-		return nil, errInvalidFixedLength
+		return nil, ErrInvalidFixedLength
 	}
 	return buf, nil
 }
 
 // Decode ...
 func (cc *FixedLengthFrameCodec) Decode(c Conn) ([]byte, error) {
+	if cc.MaxFrameLength > 0 && cc.frameLength > cc.MaxFrameLength {
+		return nil, &FrameTooLargeError{Length: cc.frameLength, Limit: cc.MaxFrameLength}
+	}
+	// ReadN在数据不足时返回已有的部分，要等整帧到达
 	size, buf := c.ReadN(cc.frameLength)
-	if size == 0 {
-		return nil, errUnexpectedEOF
+	if size < cc.frameLength {
+		return nil, ErrUnexpectedEOF
 	}
 	c.ShiftN(size)
 	return buf, nil
@@ -153,6 +300,9 @@ type DecoderConfig struct {
 	LengthAdjustment int
 	// InitialBytesToStrip is the number of first bytes to strip out from the decoded frame
 	InitialBytesToStrip int
+	// MaxFrameLength is the maximum length of a frame including the header and the length field, checked as soon
+	// as the length field is received. Zero means no limit.
+	MaxFrameLength int
 }
 
 // Encode ...
@@ -163,7 +313,7 @@ func (cc *LengthFieldBasedFrameCodec) Encode(c Conn, buf []byte) (out []byte, er
 	}
 
 	if length < 0 {
-		return nil, errTooLessLength
+		return nil, ErrTooLessLength
 	}
 
 	switch cc.encoderConfig.LengthFieldLength {
@@ -190,96 +340,138 @@ func (cc *LengthFieldBasedFrameCodec) Encode(c Conn, buf []byte) (out []byte, er
 		out = make([]byte, 8)
 		cc.encoderConfig.ByteOrder.PutUint64(out, uint64(length))
 	default:
-		return nil, errUnsupportedLength
+		return nil, ErrUnsupportedLength
 	}
 
 	out = append(out, buf...)
 	return
 }
 
-type innerBuffer []byte
-
-func (in *innerBuffer) readN(n int) (buf []byte, err error) {
-	if n <= 0 {
-		return nil, errors.New("zero or negative length is invalid")
-	} else if n > len(*in) {
-		return nil, errors.New("exceeding buffer length")
-	}
-	buf = (*in)[:n]
-	*in = (*in)[n:]
-	return
-}
-
 // Decode ...
+// 用ReadN先看长度字段之前的部分，整帧到达后再取出整帧，不合并inboundBuffer和c.buffer，也不为每帧分配内存。
+// 返回的帧可能直接引用接收缓冲区，到下一次Decode之前有效
 func (cc *LengthFieldBasedFrameCodec) Decode(c Conn) ([]byte, error) {
-	var (
-		in     innerBuffer
-		header []byte
-		err    error
-	)
-	in = c.Read()
-	if cc.decoderConfig.LengthFieldOffset > 0 { //discard header(offset)
-		header, err = in.readN(cc.decoderConfig.LengthFieldOffset)
-		if err != nil {
-			return nil, errUnexpectedEOF
-		}
+	lengthFieldEnd := cc.decoderConfig.LengthFieldOffset + cc.decoderConfig.LengthFieldLength
+	switch cc.decoderConfig.LengthFieldLength {
+	case 1, 2, 3, 4, 8:
+	default:
+		return nil, ErrUnsupportedLength
 	}
-
-	lenBuf, frameLength, err := cc.getUnadjustedFrameLength(&in)
-	if err != nil {
+	size, header := c.ReadN(lengthFieldEnd)
+	if size < lengthFieldEnd {
+		return nil, ErrUnexpectedEOF
+	}
+	frameLength := cc.getUnadjustedFrameLength(header[cc.decoderConfig.LengthFieldOffset:lengthFieldEnd])
+	if err := cc.checkFrameLength(lengthFieldEnd, frameLength); err != nil {
 		return nil, err
 	}
 
-	// real message length
-	msgLength := int(frameLength) + cc.decoderConfig.LengthAdjustment
-	msg, err := in.readN(msgLength)
-	if err != nil {
-		return nil, errUnexpectedEOF
+	// real message length，没有MaxFrameLength时8字节（32位平台上4字节）的长度字段加上偏移可能超出int的范围
+	adjustment := cc.decoderConfig.LengthAdjustment
+	if frameLength > uint64(maxInt) || adjustment > 0 && int(frameLength) > maxInt-adjustment {
+		return nil, cc.tooLarge()
+	}
+	msgLength := int(frameLength) + adjustment
+	if msgLength < 0 {
+		// 数据再多也无法解码
+		return nil, ErrTooLessLength
+	}
+	if msgLength > maxInt-lengthFieldEnd {
+		return nil, cc.tooLarge()
+	}
+	fullLength := lengthFieldEnd + msgLength
+	if cc.decoderConfig.InitialBytesToStrip > fullLength {
+		return nil, ErrTooManyBytesToStrip
+	}
+	size, frame := c.ReadN(fullLength)
+	if size < fullLength {
+		return nil, ErrUnexpectedEOF
 	}
+	c.ShiftN(fullLength)
+	return frame[cc.decoderConfig.InitialBytesToStrip:], nil
+}
 
-	fullMessage := make([]byte, len(header)+len(lenBuf)+msgLength)
-	copy(fullMessage, header)
-	copy(fullMessage[len(header):], lenBuf)
-	copy(fullMessage[len(header)+len(lenBuf):], msg)
-	c.ShiftN(len(fullMessage))
-	return fullMessage[cc.decoderConfig.InitialBytesToStrip:], nil
+// 不等消息体到达就按长度字段检查，headerLength是长度字段和它之前的字节数
+func (cc *LengthFieldBasedFrameCodec) checkFrameLength(headerLength int, frameLength uint64) error {
+	max := cc.decoderConfig.MaxFrameLength
+	if max <= 0 {
+		return nil
+	}
+	// 8字节的长度字段可能超出int64的范围
+	n := int64(maxInt)
+	if frameLength < 1<<62 {
+		n = int64(frameLength) + int64(headerLength+cc.decoderConfig.LengthAdjustment)
+	}
+	if n > int64(max) {
+		if n > int64(maxInt) {
+			n = int64(maxInt)
+		}
+		return &FrameTooLargeError{Length: int(n), Limit: max}
+	}
+	return nil
 }
 
-func (cc *LengthFieldBasedFrameCodec) getUnadjustedFrameLength(in *innerBuffer) ([]byte, uint64, error) {
+// 帧的长度超出了int的范围
+func (cc *LengthFieldBasedFrameCodec) tooLarge() error {
+	limit := cc.decoderConfig.MaxFrameLength
+	if limit <= 0 {
+		limit = maxInt
+	}
+	return &FrameTooLargeError{Length: maxInt, Limit: limit}
+}
+
+// lenBuf是完整的长度字段，LengthFieldLength已经检查过
+func (cc *LengthFieldBasedFrameCodec) getUnadjustedFrameLength(lenBuf []byte) uint64 {
 	switch cc.decoderConfig.LengthFieldLength {
 	case 1:
-		b, err := in.readN(1)
-		if err != nil {
-			return nil, 0, errUnexpectedEOF
-		}
-		return b, uint64(b[0]), nil
+		return uint64(lenBuf[0])
 	case 2:
-		lenBuf, err := in.readN(2)
-		if err != nil {
-			return nil, 0, errUnexpectedEOF
-		}
-		return lenBuf, uint64(cc.decoderConfig.ByteOrder.Uint16(lenBuf)), nil
+		return uint64(cc.decoderConfig.ByteOrder.Uint16(lenBuf))
 	case 3:
-		lenBuf, err := in.readN(3)
-		if err != nil {
-			return nil, 0, errUnexpectedEOF
-		}
-		return lenBuf, readUint24(cc.decoderConfig.ByteOrder, lenBuf), nil
+		return readUint24(cc.decoderConfig.ByteOrder, lenBuf)
 	case 4:
-		lenBuf, err := in.readN(4)
-		if err != nil {
-			return nil, 0, errUnexpectedEOF
-		}
-		return lenBuf, uint64(cc.decoderConfig.ByteOrder.Uint32(lenBuf)), nil
-	case 8:
-		lenBuf, err := in.readN(8)
-		if err != nil {
-			return nil, 0, errUnexpectedEOF
-		}
-		return lenBuf, cc.decoderConfig.ByteOrder.Uint64(lenBuf), nil
+		return uint64(cc.decoderConfig.ByteOrder.Uint32(lenBuf))
 	default:
-		return nil, 0, errUnsupportedLength
+		return cc.decoderConfig.ByteOrder.Uint64(lenBuf)
+	}
+}
+
+// Encode ...
+func (cc *VarintLengthFrameCodec) Encode(c Conn, buf []byte) ([]byte, error) {
+	if cc.MaxFrameLength > 0 && len(buf) > cc.MaxFrameLength {
+		return nil, &FrameTooLargeError{Length: len(buf), Limit: cc.MaxFrameLength}
+	}
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(buf)))
+	out := make([]byte, n+len(buf))
+	copy(out, prefix[:n])
+	copy(out[n:], buf)
+	return out, nil
+}
+
+// Decode ...
+// 和LengthFieldBasedFrameCodec一样用ReadN先看前缀，varint可能被拆在两次读到的数据中，不完整时等待更多数据
+func (cc *VarintLengthFrameCodec) Decode(c Conn) ([]byte, error) {
+	size, prefix := c.ReadN(binary.MaxVarintLen64)
+	length, n := binary.Uvarint(prefix[:size])
+	switch {
+	case n == 0 && size < binary.MaxVarintLen64:
+		// 还没有收到varint的最后一个字节
+		return nil, ErrUnexpectedEOF
+	case n <= 0 || length > uint64(maxInt-n):
+		// 10个字节都没有结束也是溢出
+		return nil, ErrVarintOverflow
+	}
+	if cc.MaxFrameLength > 0 && length > uint64(cc.MaxFrameLength) {
+		return nil, &FrameTooLargeError{Length: int(length), Limit: cc.MaxFrameLength}
+	}
+	fullLength := n + int(length)
+	size, frame := c.ReadN(fullLength)
+	if size < fullLength {
+		return nil, ErrUnexpectedEOF
 	}
+	c.ShiftN(fullLength)
+	return frame[n:], nil
 }
 
 func readUint24(byteOrder binary.ByteOrder, b []byte) uint64 {
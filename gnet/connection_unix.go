@@ -2,6 +2,9 @@ package gnet
 
 import (
 	"net"
+	"os"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sys/unix"
 	"golang_project_note/gnet/internal/netpoll"
@@ -11,6 +14,13 @@ import (
 )
 
 type conn struct {
+	// outboundBuffer的长度和AsyncWrite、AsyncWritev还没执行的字节数，其他goroutine检查MaxOutboundBuffer时用，
+	// 原子操作的int64放在最前面以保证32位平台上的对齐
+	outboundSize int64
+	asyncPending int64
+	// PauseRead、ResumeRead在任意goroutine中设置，马上对loopReact生效，poller上的注册稍后在eventloop中修改
+	userPaused int32
+
 	fd int
 	// remote socket address, accept()返回的
 	sa         unix.Sockaddr
@@ -24,10 +34,72 @@ type conn struct {
 	codec  ICodec
 	// 整合c.buffer + c.inboundBuffer，方便统一取出
 	byteBuffer *bytebuffer.ByteBuffer
+	// Decode返回的帧可能引用的byteBuffer，React中的Read、ReadN会使用新的byteBuffer，所以React返回之前它一直有效
+	frameBuffer *bytebuffer.ByteBuffer
 	// buffer处理后剩余的数据会存入inboundBuffer，所以会先从这里取数据
 	inboundBuffer *ringbuffer.RingBuffer
+	// 分隔符类的codec已经查找过、没有分隔符的数据长度，ShiftN、ResetBuffer时清零
+	scanned int
 	// 发送给客户端的缓冲区，write不完会放到缓冲里
 	outboundBuffer *ringbuffer.RingBuffer
+	// SetReadDeadline/SetWriteDeadline设置的绝对时间，零值表示没有
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// 最近一次读到数据、写出数据的时间，只有配置了相应的超时才会记录
+	lastRead  time.Time
+	lastWrite time.Time
+	// 检查超时的定时器，只在最早的超时时间触发一次，到期时再计算下一次
+	timeout timer
+	// SendFile排队中的文件，和outboundBuffer中的数据按调用顺序发送
+	files []*fileSegment
+	// outboundBuffer的低、高水位，默认取自Options
+	lowWatermark  int
+	highWatermark int
+	// 已经越过高水位，等待降到低水位
+	backpressured bool
+	// 暂停读的原因，为0时才会读
+	readPaused uint8
+	// Options.AsyncReact时的状态，见react_unix.go
+	async *asyncReact
+	// Dial的连接在非阻塞connect完成之前为true
+	connecting bool
+	// 启用TLS时的状态，见tls_unix.go
+	tls *tlsConn
+	// UDP数据报的目的地址，回复时作为源地址
+	pktInfo netpoll.PktInfo
+	// 打开时设置的socket选项，Register的连接为nil
+	sockopts *SocketOptions
+}
+
+// 暂停读的原因
+const (
+	pausedByBackpressure uint8 = 1 << iota
+	pausedByUser
+	// AsyncReact时同时执行的React达到上限，或者pool已满
+	pausedByReact
+)
+
+func (c *conn) readingPaused() bool {
+	return c.readPaused != 0 || atomic.LoadInt32(&c.userPaused) != 0
+}
+
+// 一次sendfile最多发送的字节数
+const sendFileChunk = 4 << 20
+
+type fileSegment struct {
+	// dup出来的fd，发送完或者连接关闭时关闭
+	fd        int
+	offset    int64
+	remaining int64
+	// outboundBuffer中排在这个文件之前（上一个文件之后）的字节数，要先于文件发送
+	before int
+}
+
+func (seg *fileSegment) chunk() int {
+	if seg.remaining > sendFileChunk {
+		return sendFileChunk
+	}
+	return int(seg.remaining)
 }
 
 func newTCPConn(fd int, el *eventloop, sa unix.Sockaddr) *conn {
@@ -38,6 +110,9 @@ func newTCPConn(fd int, el *eventloop, sa unix.Sockaddr) *conn {
 		codec:          el.codec,
 		inboundBuffer:  prb.Get(),
 		outboundBuffer: prb.Get(),
+		timeout:        timer{loop: el},
+		lowWatermark:   el.svr.opts.OutboundLowWatermark,
+		highWatermark:  el.svr.opts.OutboundHighWatermark,
 	}
 }
 
@@ -53,28 +128,38 @@ func (c *conn) releaseTCP() {
 	prb.Put(c.outboundBuffer)
 	c.inboundBuffer = nil
 	c.outboundBuffer = nil
-	bytebuffer.Put(c.byteBuffer)
-	c.byteBuffer = nil
+	c.releaseByteBuffer()
+	c.releaseFrameBuffer()
 }
 
-func newUDPConn(fd int, el *eventloop, sa unix.Sockaddr) *conn {
-	return &conn{
+// 每个数据报使用单独的conn，React返回后其他goroutine可能还在用它SendTo，所以之后不能再清空或者复用
+func newUDPConn(fd int, ln *listener, sa unix.Sockaddr, info netpoll.PktInfo) *conn {
+	c := &conn{
 		fd:         fd,
 		sa:         sa,
-		localAddr:  el.svr.ln.lnaddr,
+		localAddr:  ln.lnaddr,
 		remoteAddr: netpoll.SockaddrToUDPAddr(sa),
+		pktInfo:    info,
 	}
-}
-
-func (c *conn) releaseUDP() {
-	c.ctx = nil
-	c.localAddr = nil
-	c.remoteAddr = nil
+	if info.IP != nil {
+		c.localAddr = info.UDPAddr(ln.lnaddr.(*net.UDPAddr).Port)
+	}
+	return c
 }
 
 // 如果 el.eventHandler.OnOpened() 有需要返回给client的，会调用open来处理
 func (c *conn) open(buf []byte) {
-	n, err := unix.Write(c.fd, buf)
+	if c.tls != nil {
+		c.write(buf)
+		return
+	}
+	// OnOpened中调用过Writev、SendFile，返回的数据要排在它们后面
+	if c.pendingOutput() {
+		_, _ = c.outboundBuffer.Write(buf)
+		return
+	}
+	n, err := c.loop.poller.Write(c.fd, buf)
+	c.loop.touchWrite(c)
 	if err != nil {
 		_, _ = c.outboundBuffer.Write(buf)
 		return
@@ -85,34 +170,190 @@ func (c *conn) open(buf []byte) {
 	}
 }
 
+// 上一帧可能在frameBuffer中，React返回后才能释放，所以放到下一次Decode之前；
+// 没有解码出帧时byteBuffer中只有ReadN看过的数据，直接释放
 func (c *conn) read() ([]byte, error) {
-	return c.codec.Decode(c)
+	c.releaseByteBuffer()
+	c.releaseFrameBuffer()
+	frame, err := c.codec.Decode(c)
+	if frame == nil {
+		c.releaseByteBuffer()
+		return nil, err
+	}
+	c.frameBuffer, c.byteBuffer = c.byteBuffer, nil
+	return frame, err
+}
+
+func (c *conn) releaseFrameBuffer() {
+	if c.frameBuffer != nil {
+		bytebuffer.Put(c.frameBuffer)
+		c.frameBuffer = nil
+	}
+}
+
+func (c *conn) releaseByteBuffer() {
+	if c.byteBuffer != nil {
+		bytebuffer.Put(c.byteBuffer)
+		c.byteBuffer = nil
+	}
 }
 
+// 写出明文，TLS连接先加密，握手完成之前的数据先缓存
 func (c *conn) write(buf []byte) {
-	if !c.outboundBuffer.IsEmpty() {
-		_, _ = c.outboundBuffer.Write(buf)
+	if c.tls != nil {
+		if !c.tls.ready {
+			c.writeEarly(buf)
+			return
+		}
+		// 加密后的记录经过tlsConn.Write交给send
+		_, _ = c.tls.conn.Write(buf)
 		return
 	}
-	n, err := unix.Write(c.fd, buf)
+	c.send(buf)
+}
+
+// 直接写到socket，写不完的部分放进outboundBuffer
+func (c *conn) send(buf []byte) {
+	if c.pendingOutput() {
+		// 积压的数据和buf一次writev写出，socket有空间时buf不需要再拷贝到outboundBuffer
+		c.loop.frame[0] = buf
+		_ = c.writev(c.loop.frame[:])
+		c.loop.frame[0] = nil
+		return
+	}
+	n, err := c.loop.poller.Write(c.fd, buf)
+	c.loop.touchWrite(c)
 	if err != nil {
-		if err == unix.EAGAIN {
-			_, _ = c.outboundBuffer.Write(buf)
-			_ = c.loop.poller.ModReadWrite(c.fd)
+		if err != unix.EAGAIN {
+			_ = c.loop.loopCloseConn(c, err)
 			return
 		}
-		_ = c.loop.loopCloseConn(c, err)
-		return
+		n = 0
 	}
 	if n < len(buf) {
 		_, _ = c.outboundBuffer.Write(buf[n:])
-		_ = c.loop.poller.ModReadWrite(c.fd)
+		c.loop.modEvents(c)
+		c.loop.scheduleTimeout(c)
+		c.loop.checkWatermarks(c)
+	}
+}
+
+// outboundBuffer中积压的数据和bufs用一次writev写出，写不完的部分按顺序追加到outboundBuffer，
+// 出错时关闭连接并返回写入的错误
+func (c *conn) writev(bufs [][]byte) error {
+	el := c.loop
+	if len(c.files) > 0 {
+		// 排在文件后面，等文件发送完再写
+		for _, buf := range bufs {
+			_, _ = c.outboundBuffer.Write(buf)
+		}
+		el.checkWatermarks(c)
+		return nil
+	}
+	pending := c.outboundBuffer.Length()
+	iov := el.iov[:0]
+	if pending > 0 {
+		head, tail := c.outboundBuffer.LazyReadAll()
+		iov = append(iov, head)
+		if len(tail) > 0 {
+			iov = append(iov, tail)
+		}
+	}
+	iov = append(iov, bufs...)
+	n, err := el.poller.Writev(c.fd, iov)
+	// 不再持有调用方的缓冲区
+	for i := range iov {
+		iov[i] = nil
+	}
+	el.iov = iov[:0]
+	if err != nil {
+		if err != unix.EAGAIN {
+			_ = el.loopCloseConn(c, err)
+			return err
+		}
+		n = 0
+	}
+	if n > 0 || pending == 0 {
+		el.touchWrite(c)
+	}
+
+	if n < pending {
+		c.outboundBuffer.Shift(n)
+		n = 0
+	} else {
+		c.outboundBuffer.Shift(pending)
+		n -= pending
+	}
+	for _, buf := range bufs {
+		if n >= len(buf) {
+			n -= len(buf)
+			continue
+		}
+		_, _ = c.outboundBuffer.Write(buf[n:])
+		n = 0
+	}
+	if !c.outboundBuffer.IsEmpty() {
+		if pending == 0 {
+			el.modEvents(c)
+		}
+		el.scheduleTimeout(c)
+	}
+	el.checkWatermarks(c)
+	return nil
+}
+
+// 还有数据或者文件没有发送完
+func (c *conn) pendingOutput() bool {
+	return !c.outboundBuffer.IsEmpty() || len(c.files) > 0
+}
+
+func (c *conn) popFile() {
+	_ = unix.Close(c.files[0].fd)
+	c.files[0] = nil
+	c.files = c.files[1:]
+	if len(c.files) == 0 {
+		c.files = nil
+	}
+}
+
+func (c *conn) closeFiles() {
+	for len(c.files) > 0 {
+		c.popFile()
+	}
+}
+
+// 返回最早的超时时间和到期时关闭连接使用的错误，零值表示不会超时。
+// 写超时只在outboundBuffer中有数据时才生效
+func (c *conn) nextDeadline() (when time.Time, err error) {
+	earliest := func(t time.Time, e error) {
+		if !t.IsZero() && (when.IsZero() || t.Before(when)) {
+			when, err = t, e
+		}
+	}
+	opts := c.loop.svr.opts
+	if opts.IdleTimeout > 0 {
+		last := c.lastRead
+		if c.lastWrite.After(last) {
+			last = c.lastWrite
+		}
+		earliest(last.Add(opts.IdleTimeout), ErrIdleTimeout)
+	}
+	earliest(c.readDeadline, ErrReadTimeout)
+	if opts.ReadTimeout > 0 {
+		earliest(c.lastRead.Add(opts.ReadTimeout), ErrReadTimeout)
 	}
+	if c.pendingOutput() {
+		earliest(c.writeDeadline, ErrWriteTimeout)
+		if opts.WriteTimeout > 0 {
+			earliest(c.lastWrite.Add(opts.WriteTimeout), ErrWriteTimeout)
+		}
+	}
+	return
 }
 
-// UDP写，因为UDP没有连接的概念，所以每次都要传对端地址
+// UDP写，因为UDP没有连接的概念，所以每次都要传对端地址，源地址是收到数据报的地址
 func (c *conn) sendTo(buf []byte) error {
-	return unix.Sendto(c.fd, buf, 0, c.sa)
+	return netpoll.SendMsg(c.fd, buf, c.sa, &c.pktInfo)
 }
 
 func (c *conn) Read() []byte {
@@ -120,16 +361,16 @@ func (c *conn) Read() []byte {
 		return c.buffer
 	}
 	// 读取 c.inboundBuffer + c.buffer
+	c.releaseByteBuffer()
 	c.byteBuffer = c.inboundBuffer.WithByteBuffer(c.buffer)
 	return c.byteBuffer.Bytes()
 }
 
-// 清空接收缓冲区
+// 清空接收缓冲区，Read返回的数据可能在byteBuffer中，不释放，到下一次Read、ReadN之前都有效
 func (c *conn) ResetBuffer() {
 	c.buffer = c.buffer[:0]
 	c.inboundBuffer.Reset()
-	bytebuffer.Put(c.byteBuffer)
-	c.byteBuffer = nil
+	c.scanned = 0
 }
 
 func (c *conn) ReadN(n int) (size int, buf []byte) {
@@ -145,9 +386,14 @@ func (c *conn) ReadN(n int) (size int, buf []byte) {
 		buf = c.buffer[:n]
 		return
 	}
-	// c.byteBuffer装的是n个字节
+	// c.byteBuffer装的是n个字节，同一次Decode中多次ReadN时复用，每次都从头写入，
+	// 所以之前返回的buf的内容不变
 	head, tail := c.inboundBuffer.LazyRead(n)
-	c.byteBuffer = bytebuffer.Get()
+	if c.byteBuffer == nil {
+		c.byteBuffer = bytebuffer.Get()
+	} else {
+		c.byteBuffer.Reset()
+	}
 	_, _ = c.byteBuffer.Write(head)
 	_, _ = c.byteBuffer.Write(tail)
 	// 可以从byteBuffer中一次性取完
@@ -164,6 +410,7 @@ func (c *conn) ReadN(n int) (size int, buf []byte) {
 }
 
 func (c *conn) ShiftN(n int) (size int) {
+	c.scanned = 0
 	inBufferLen := c.inboundBuffer.Length()
 	tempBufferLen := len(c.buffer)
 	if inBufferLen+tempBufferLen < n || n <= 0 {
@@ -177,13 +424,14 @@ func (c *conn) ShiftN(n int) (size int) {
 		return
 	}
 
-	bytebuffer.Put(c.byteBuffer)
-	c.byteBuffer = nil
+	// ReadN返回的数据可能在byteBuffer中，不释放，到下一次Read、ReadN之前都有效
 	if inBufferLen > n {
 		c.inboundBuffer.Shift(n)
 		return
 	}
 
+	// inboundBuffer全部读完，剩余的从c.buffer中跳过
+	c.inboundBuffer.Reset()
 	restSize := n - inBufferLen
 	c.buffer = c.buffer[restSize:]
 	return
@@ -193,20 +441,120 @@ func (c *conn) BufferLength() int {
 	return c.inboundBuffer.Length() + len(c.buffer)
 }
 
+// 在其他goroutine中为AsyncWrite、AsyncWritev预留n个字节，超过MaxOutboundBuffer时返回false。
+// outboundBuffer的长度只能通过eventloop更新的outboundSize看到，可能稍微滞后
+func (c *conn) reserveOutbound(n int) bool {
+	max := c.loop.svr.opts.MaxOutboundBuffer
+	if max <= 0 {
+		return true
+	}
+	if atomic.AddInt64(&c.asyncPending, int64(n))+atomic.LoadInt64(&c.outboundSize) > int64(max) {
+		atomic.AddInt64(&c.asyncPending, -int64(n))
+		return false
+	}
+	return true
+}
+
+// 在写入outboundBuffer之后再释放，这样其他goroutine不会看到数据既不在asyncPending也不在outboundSize的时刻
+func (c *conn) releaseOutbound(n int) {
+	if c.loop.svr.opts.MaxOutboundBuffer > 0 {
+		atomic.AddInt64(&c.asyncPending, -int64(n))
+	}
+}
+
 // TCP的异步写
 func (c *conn) AsyncWrite(buf []byte) (err error) {
 	var encodeBuf []byte
 	if encodeBuf, err = c.codec.Encode(c, buf); err == nil {
+		n := len(encodeBuf)
+		if !c.reserveOutbound(n) {
+			return ErrOutboundBufferFull
+		}
 		return c.loop.poller.Trigger(func() error {
 			if c.opened {
 				c.write(encodeBuf)
+			} else if c.connecting || c.handshaking() {
+				// 连接建立、握手完成后再发送
+				c.writeEarly(encodeBuf)
 			}
+			c.releaseOutbound(n)
 			return nil
 		})
 	}
 	return
 }
 
+func (c *conn) Writev(bufs [][]byte) error {
+	if !c.opened {
+		return nil
+	}
+	if c.tls != nil {
+		for _, buf := range bufs {
+			c.write(buf)
+		}
+		return nil
+	}
+	return c.writev(bufs)
+}
+
+func (c *conn) AsyncWritev(bufs [][]byte) error {
+	var n int
+	for _, buf := range bufs {
+		n += len(buf)
+	}
+	if !c.reserveOutbound(n) {
+		return ErrOutboundBufferFull
+	}
+	return c.loop.poller.Trigger(func() error {
+		if c.opened {
+			_ = c.Writev(bufs)
+		} else if c.connecting || c.handshaking() {
+			for _, buf := range bufs {
+				c.writeEarly(buf)
+			}
+		}
+		c.releaseOutbound(n)
+		return nil
+	})
+}
+
+func (c *conn) SendFile(f *os.File, offset, count int64) error {
+	if !c.opened || count <= 0 {
+		return nil
+	}
+	if c.tls != nil {
+		return c.sendFileTLS(f, offset, count)
+	}
+	// dup一份，调用方可以在SendFile返回后马上关闭f
+	fd, err := unix.Dup(int(f.Fd()))
+	if err != nil {
+		return err
+	}
+	unix.CloseOnExec(fd)
+
+	wasPending := c.pendingOutput()
+	before := c.outboundBuffer.Length()
+	for _, seg := range c.files {
+		before -= seg.before
+	}
+	c.files = append(c.files, &fileSegment{fd: fd, offset: offset, remaining: count, before: before})
+	if wasPending {
+		// 已经在等可写事件了
+		return nil
+	}
+	el := c.loop
+	el.eventHandler.PreWrite()
+	if err = el.flush(c); err != nil || !c.opened {
+		return nil
+	}
+	if c.pendingOutput() {
+		el.modEvents(c)
+		el.scheduleTimeout(c)
+	}
+	el.checkWatermarks(c)
+	return nil
+}
+
 func (c *conn) SendTo(buf []byte) error {
 	return c.sendTo(buf)
 }
@@ -217,12 +565,100 @@ func (c *conn) Wake() error {
 	})
 }
 
+func (c *conn) PauseRead() error {
+	if c.loop == nil {
+		return ErrUnsupportedProtocol
+	}
+	atomic.StoreInt32(&c.userPaused, 1)
+	return c.loop.poller.Trigger(func() error {
+		// 期间可能又调用了ResumeRead，以最后一次调用为准
+		if c.opened && atomic.LoadInt32(&c.userPaused) != 0 {
+			c.loop.pauseRead(c, pausedByUser)
+		}
+		return nil
+	})
+}
+
+func (c *conn) ResumeRead() error {
+	if c.loop == nil {
+		return ErrUnsupportedProtocol
+	}
+	atomic.StoreInt32(&c.userPaused, 0)
+	return c.loop.poller.Trigger(func() error {
+		if !c.opened || atomic.LoadInt32(&c.userPaused) != 0 {
+			return nil
+		}
+		if c.readPaused&pausedByUser != 0 {
+			c.loop.resumeRead(c, pausedByUser)
+			return nil
+		}
+		// 暂停的job还没执行就恢复了，loopReact可能因此停下过，同样要处理inboundBuffer中剩下的帧
+		return c.loop.loopResumeRead(c)
+	})
+}
+
 func (c *conn) Close() error {
 	return c.loop.poller.Trigger(func() error {
 		return c.loop.loopCloseConn(c, nil)
 	})
 }
 
+func (c *conn) SetDeadline(t time.Time) error {
+	if !c.opened {
+		// 连接已经关闭，或者是没有连接概念的UDP
+		return nil
+	}
+	c.readDeadline, c.writeDeadline = t, t
+	c.loop.scheduleTimeout(c)
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	if !c.opened {
+		return nil
+	}
+	c.readDeadline = t
+	c.loop.scheduleTimeout(c)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	if !c.opened {
+		return nil
+	}
+	c.writeDeadline = t
+	c.loop.scheduleTimeout(c)
+	return nil
+}
+
+func (c *conn) AfterFunc(d time.Duration, f func(c Conn)) Timer {
+	t := &timer{loop: c.loop, f: func() error {
+		if c.opened {
+			f(c)
+		}
+		return nil
+	}}
+	if c.opened {
+		c.loop.addTimer(t, time.Now().Add(d))
+	}
+	return t
+}
+
+func (c *conn) EventLoop() EventLoop {
+	if c.loop == nil {
+		// UDP的conn只在一次React中有效，不属于某个eventloop
+		return nil
+	}
+	return c.loop
+}
+
+func (c *conn) SetOutboundWatermarks(low, high int) {
+	c.lowWatermark, c.highWatermark = low, high
+	if c.opened {
+		c.loop.checkWatermarks(c)
+	}
+}
+
 func (c *conn) Context() interface{}       { return c.ctx }
 func (c *conn) SetContext(ctx interface{}) { c.ctx = ctx }
 func (c *conn) LocalAddr() net.Addr        { return c.localAddr }
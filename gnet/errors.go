@@ -1,25 +1,99 @@
 package gnet
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrUnsupportedProtocol occurs when trying to use protocol that is not supported.
 	ErrUnsupportedProtocol = errors.New("unsupported protocol on this platform")
 	// ErrUnsupportedPlatform occurs when running gnet on an unsupported platform.
 	ErrUnsupportedPlatform = errors.New("unsupported platform in gnet")
+	// ErrServerNotFound occurs when trying to stop a server that is not serving on the given address.
+	ErrServerNotFound = errors.New("no server is serving on this address")
+	// ErrServerInShutdown occurs when trying to stop a server that is already in shutdown.
+	ErrServerInShutdown = errors.New("server is already in shutdown")
+	// ErrIdleTimeout occurs when a connection has no read or write activity for Options.IdleTimeout.
+	ErrIdleTimeout = errors.New("connection idle timeout")
+	// ErrReadTimeout occurs when a connection receives no data before its read deadline.
+	ErrReadTimeout = errors.New("connection read timeout")
+	// ErrWriteTimeout occurs when a connection cannot flush its outbound buffer before its write deadline.
+	ErrWriteTimeout = errors.New("connection write timeout")
+	// ErrOutboundBufferFull occurs when AsyncWrite or AsyncWritev would buffer more than Options.MaxOutboundBuffer
+	// bytes on a connection.
+	ErrOutboundBufferFull = errors.New("outbound buffer of the connection is full")
+	// ErrInvalidEventLoop occurs when registering a connection to an event-loop of another engine.
+	ErrInvalidEventLoop = errors.New("event-loop does not belong to this engine")
+	// ErrUnsupportedLinger occurs when Start or NewClient is given a positive SocketLinger. Connections are closed on
+	// the event-loop, where a lingering close would block every other connection of that loop, so only a negative
+	// value (reset the connection on close) is supported.
+	ErrUnsupportedLinger = errors.New("positive SocketLinger is not supported")
+
+	// ErrIncompleteFrame occurs when the inbound data does not form a complete frame yet. ICodec.Decode returns it,
+	// or an error matching it with errors.Is, to wait for more data; any other error of Decode or Encode is fatal
+	// and passed to ErrorHandler.OnError.
+	ErrIncompleteFrame = errors.New("incomplete frame")
+	// ErrUnexpectedEOF occurs when no enough data to read by codec, it matches ErrIncompleteFrame.
+	ErrUnexpectedEOF error = &incompleteFrameError{"there is no enough data"}
+	// ErrDelimiterNotFound occurs when no such a delimiter is in input data, it matches ErrIncompleteFrame.
+	ErrDelimiterNotFound error = &incompleteFrameError{"there is no such a delimiter"}
+	// ErrCRLFNotFound occurs when a CRLF is not found by codec, it matches ErrIncompleteFrame.
+	ErrCRLFNotFound error = &incompleteFrameError{"there is no CRLF"}
+	// ErrInvalidFixedLength occurs when the output data have invalid fixed length.
+	ErrInvalidFixedLength = errors.New("invalid fixed length of bytes")
+	// ErrUnsupportedLength occurs when unsupported lengthFieldLength is from input data.
+	ErrUnsupportedLength = errors.New("unsupported lengthFieldLength. (expected: 1, 2, 3, 4, or 8)")
+	// ErrTooLessLength occurs when adjusted frame length is less than zero.
+	ErrTooLessLength = errors.New("adjusted frame length is less than zero")
+	// ErrTooManyBytesToStrip occurs when DecoderConfig.InitialBytesToStrip is larger than the whole frame including
+	// its length field.
+	ErrTooManyBytesToStrip = errors.New("initialBytesToStrip is larger than the frame")
+	// ErrVarintOverflow occurs when the varint length prefix of VarintLengthFrameCodec overflows a 64-bit integer
+	// or the int type.
+	ErrVarintOverflow = errors.New("varint length prefix overflows")
+	// ErrFrameTooLarge is matched by every *FrameTooLargeError with errors.Is.
+	ErrFrameTooLarge = errors.New("frame too large")
 
 	// errServerShutdown occurs when server is closing.
 	errServerShutdown = errors.New("server is going to be shutdown")
-	// errInvalidFixedLength occurs when the output data have invalid fixed length.
-	errInvalidFixedLength = errors.New("invalid fixed length of bytes")
-	// errUnexpectedEOF occurs when no enough data to read by codec.
-	errUnexpectedEOF = errors.New("there is no enough data")
-	// errDelimiterNotFound occurs when no such a delimiter is in input data.
-	errDelimiterNotFound = errors.New("there is no such a delimiter")
-	// errCRLFNotFound occurs when a CRLF is not found by codec.
-	errCRLFNotFound = errors.New("there is no CRLF")
-	// errUnsupportedLength occurs when unsupported lengthFieldLength is from input data.
-	errUnsupportedLength = errors.New("unsupported lengthFieldLength. (expected: 1, 2, 3, 4, or 8)")
-	// errTooLessLength occurs when adjusted frame length is less than zero.
-	errTooLessLength = errors.New("adjusted frame length is less than zero")
 )
+
+// FrameTooLargeError occurs when a codec meets a frame longer than its MaxFrameLength, or when the data of a connection
+// that has not been decoded into frames exceeds Options.MaxInboundBuffer. The connection is closed and OnClosed
+// receives the error.
+type FrameTooLargeError struct {
+	// Length is the length of the frame, or the number of buffered bytes when the frame is not complete yet.
+	// A length that does not fit in an int, such as a 4-byte length field above math.MaxInt32 on 32-bit platforms,
+	// is reported as the largest int.
+	Length int
+	// Limit is the MaxFrameLength of the codec or Options.MaxInboundBuffer.
+	Limit int
+	// Inbound reports whether Options.MaxInboundBuffer is exceeded instead of MaxFrameLength of the codec.
+	Inbound bool
+}
+
+func (e *FrameTooLargeError) Error() string {
+	if e.Inbound {
+		return fmt.Sprintf("inbound buffer of %d bytes exceeds the limit of %d bytes", e.Length, e.Limit)
+	}
+	return fmt.Sprintf("frame of %d bytes exceeds the limit of %d bytes", e.Length, e.Limit)
+}
+
+// Is reports whether target is ErrFrameTooLarge.
+func (e *FrameTooLargeError) Is(target error) bool {
+	return target == ErrFrameTooLarge
+}
+
+// 数据不足的错误，都可以用errors.Is(err, ErrIncompleteFrame)判断
+type incompleteFrameError struct {
+	msg string
+}
+
+func (e *incompleteFrameError) Error() string {
+	return e.msg
+}
+
+func (e *incompleteFrameError) Is(target error) bool {
+	return target == ErrIncompleteFrame
+}
@@ -1,7 +1,11 @@
 package gnet
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -22,6 +26,24 @@ type eventloop struct {
 	eventHandler EventHandler
 	// 负载均衡的再调整
 	calibrateCallback func(*eventloop, int32)
+	// 定时器，见timer_unix.go，第一次添加定时器时才创建
+	wheel     *timingWheel
+	wakeTimer *time.Timer
+	wakeAt    time.Time
+	// writev用的缓冲区，复用以避免每次写都分配
+	iov   [][]byte
+	frame [1][]byte
+	// TLS连接解密出的明文，第一次用到时才创建
+	tlsBuffer []byte
+	// 读UDP数据报时接收目的地址的控制消息
+	oob []byte
+}
+
+func (el *eventloop) String() string {
+	if el.idx < 0 {
+		return "main reactor"
+	}
+	return fmt.Sprintf("event-loop:%d", el.idx)
 }
 
 func (el *eventloop) closeAllConns() {
@@ -31,16 +53,34 @@ func (el *eventloop) closeAllConns() {
 }
 
 func (el *eventloop) loopCloseConn(c *conn, err error) error {
-	// 正常关闭，还有数据没发送给客户端
-	if !c.outboundBuffer.IsEmpty() && err == nil {
+	// 正常关闭TLS连接时发送close_notify，和outboundBuffer中的数据一起发出
+	if t := c.tls; t != nil && t.ready && !t.closed && err == nil && c.opened {
+		_ = t.conn.CloseWrite()
+		// 写出错时连接已经被关闭了
+		if t.closed {
+			return nil
+		}
+	}
+	// 正常关闭，还有数据没发送给客户端；还在connect、TLS握手的连接不发送
+	if c.pendingOutput() && err == nil && c.opened {
 		_ = el.loopWrite(c)
+		// 写出错时连接已经被关闭了
+		if !c.opened {
+			return nil
+		}
 	}
 	// 1. 删除fd上的注册事件
 	// 2. 关闭fd
 	err0, err1 := el.poller.Delete(c.fd), unix.Close(c.fd)
 	if err0 == nil && err1 == nil {
 		delete(el.connections, c.fd)
-		// 负载均衡的再调整
+		c.timeout.Stop()
+		c.closeFiles()
+		c.releaseAsync()
+		if c.tls != nil {
+			c.tls.close()
+		}
+		// 负载均衡的再调整，握手没有完成的连接在加入el.connections时也计过数
 		el.calibrateCallback(el, -1)
 		switch el.eventHandler.OnClosed(c, err) {
 		case Shutdown:
@@ -62,59 +102,305 @@ func (el *eventloop) loopCloseConn(c *conn, err error) error {
 func (el *eventloop) loopWrite(c *conn) error {
 	el.eventHandler.PreWrite()
 
-	head, tail := c.outboundBuffer.LazyReadAll()
-	n, err := unix.Write(c.fd, head)
-	if err != nil {
-		if err == unix.EAGAIN {
-			return nil
+	if err := el.flush(c); err != nil || !c.opened {
+		return err
+	}
+	// 数据都发送完了，不需要再监听可写事件
+	if !c.pendingOutput() {
+		el.modEvents(c)
+	}
+	el.checkWatermarks(c)
+	return nil
+}
+
+// 按是否暂停读、是否有数据要写修改fd上监听的事件
+func (el *eventloop) modEvents(c *conn) {
+	switch read, write := c.readPaused == 0, c.pendingOutput(); {
+	case read && write:
+		_ = el.poller.ModReadWrite(c.fd)
+	case read:
+		_ = el.poller.ModRead(c.fd)
+	case write:
+		_ = el.poller.ModWrite(c.fd)
+	default:
+		_ = el.poller.ModNone(c.fd)
+	}
+}
+
+func (el *eventloop) pauseRead(c *conn, reason uint8) {
+	paused := c.readPaused != 0
+	c.readPaused |= reason
+	if !paused {
+		el.modEvents(c)
+	}
+}
+
+func (el *eventloop) resumeRead(c *conn, reason uint8) {
+	if c.readPaused&reason == 0 {
+		return
+	}
+	if c.readPaused &^= reason; c.readPaused != 0 {
+		return
+	}
+	el.modEvents(c)
+	// 暂停时inboundBuffer中可能还有没处理的帧，socket上却不一定会再有可读事件，
+	// 放到下一轮处理，避免在React、OnWritable中重入
+	_ = el.poller.Trigger(func() error {
+		return el.loopResumeRead(c)
+	})
+}
+
+func (el *eventloop) loopResumeRead(c *conn) error {
+	if !c.opened || c.readingPaused() {
+		return nil
+	}
+	if err := el.loopReact(c); err != nil || !c.opened || c.readingPaused() {
+		return err
+	}
+	return el.loopRead(c)
+}
+
+// outboundBuffer变化后调用：更新AsyncWrite检查MaxOutboundBuffer用的长度，
+// 越过高水位时暂停读，降到低水位及以下时恢复
+func (el *eventloop) checkWatermarks(c *conn) {
+	size := c.outboundBuffer.Length()
+	if el.svr.opts.MaxOutboundBuffer > 0 {
+		atomic.StoreInt64(&c.outboundSize, int64(size))
+	}
+	high, low := c.highWatermark, c.lowWatermark
+	if low > high {
+		low = high
+	}
+	switch {
+	case !c.backpressured && high > 0 && size > high:
+		c.backpressured = true
+		el.pauseRead(c, pausedByBackpressure)
+		if h, ok := el.eventHandler.(BackpressureHandler); ok {
+			h.OnBackpressure(c)
+		}
+	case c.backpressured && (high <= 0 || size <= low):
+		c.backpressured = false
+		el.resumeRead(c, pausedByBackpressure)
+		if h, ok := el.eventHandler.(BackpressureHandler); ok {
+			h.OnWritable(c)
 		}
-		return el.loopCloseConn(c, err)
 	}
-	c.outboundBuffer.Shift(n)
+}
 
-	// 前提必须是head已经写完，才能写tail，不然数据会错乱
-	if len(head) == n && tail != nil {
-		n, err = unix.Write(c.fd, tail)
+// 按顺序发送outboundBuffer中的数据和SendFile排队的文件，直到发完或者socket缓冲区满了
+func (el *eventloop) flush(c *conn) error {
+	for c.pendingOutput() {
+		var (
+			n, expected int
+			err         error
+		)
+		if len(c.files) > 0 && c.files[0].before == 0 {
+			// 文件之前的数据都发完了，开始发送文件
+			seg := c.files[0]
+			expected = seg.chunk()
+			n, err = el.poller.SendFile(c.fd, seg.fd, seg.offset, expected)
+			seg.offset += int64(n)
+			seg.remaining -= int64(n)
+			if seg.remaining == 0 {
+				c.popFile()
+			} else if n == 0 && err == nil {
+				// 文件比SendFile指定的count短
+				return el.loopCloseConn(c, io.ErrUnexpectedEOF)
+			}
+		} else {
+			// head和tail用一次writev写出，有文件在排队时只写到文件之前
+			head, tail := c.outboundBuffer.LazyReadAll()
+			if len(c.files) > 0 {
+				before := c.files[0].before
+				if len(head) >= before {
+					head, tail = head[:before], nil
+				} else if len(head)+len(tail) > before {
+					tail = tail[:before-len(head)]
+				}
+			}
+			el.iov = append(el.iov[:0], head)
+			if len(tail) > 0 {
+				el.iov = append(el.iov, tail)
+			}
+			expected = len(head) + len(tail)
+			n, err = el.poller.Writev(c.fd, el.iov)
+			el.iov[0] = nil
+			if len(el.iov) > 1 {
+				el.iov[1] = nil
+			}
+			if err != nil {
+				n = 0
+			}
+			c.outboundBuffer.Shift(n)
+			if len(c.files) > 0 {
+				c.files[0].before -= n
+			}
+		}
+		if n > 0 {
+			el.touchWrite(c)
+		}
 		if err != nil {
 			if err == unix.EAGAIN {
 				return nil
 			}
 			return el.loopCloseConn(c, err)
 		}
-		c.outboundBuffer.Shift(n)
+
+		// 水平触发下写不完的数据等下一次可写事件即可；
+		// 边缘触发必须写到EAGAIN，否则不会再有可写通知
+		if !el.svr.opts.EdgeTriggered && n < expected {
+			break
+		}
 	}
+	return nil
+}
 
-	// 数据都发送完了，fd设置可读事件（不需要监听可写事件了）
-	if c.outboundBuffer.IsEmpty() {
-		_ = el.poller.ModRead(c.fd)
+// 只有配置了相应的超时才需要记录读写时间，避免每次读写都调用time.Now()
+func (el *eventloop) touchRead(c *conn) {
+	if el.svr.opts.ReadTimeout > 0 || el.svr.opts.IdleTimeout > 0 {
+		c.lastRead = time.Now()
 	}
+}
+
+func (el *eventloop) touchWrite(c *conn) {
+	if el.svr.opts.WriteTimeout > 0 || el.svr.opts.IdleTimeout > 0 {
+		c.lastWrite = time.Now()
+	}
+}
+
+// 超时时间提前了才需要调整定时器，推后的情况等定时器到期时再重新计算
+func (el *eventloop) scheduleTimeout(c *conn) {
+	when, _ := c.nextDeadline()
+	if when.IsZero() || (c.timeout.list != nil && !when.Before(c.timeout.when)) {
+		return
+	}
+	if c.timeout.f == nil {
+		c.timeout.f = func() error {
+			return el.loopTimeout(c)
+		}
+	}
+	el.addTimer(&c.timeout, when)
+}
+
+func (el *eventloop) loopTimeout(c *conn) error {
+	if !c.opened && !c.handshaking() {
+		return nil
+	}
+	when, err := c.nextDeadline()
+	if when.IsZero() {
+		return nil
+	}
+	if !time.Now().Before(when) {
+		return el.loopCloseConn(c, err)
+	}
+	el.addTimer(&c.timeout, when)
 	return nil
 }
 
 func (el *eventloop) loopWake(c *conn) error {
 	out, action := el.eventHandler.React(nil, c)
 	if out != nil {
-		frame, _ := el.codec.Encode(c, out)
+		frame, err := el.encode(c, out)
+		if err != nil || !c.opened {
+			return err
+		}
 		c.write(frame)
 	}
 	return el.handleAction(c, action)
 }
 
+// Encode出错时交给handleError，丢弃out时返回nil
+func (el *eventloop) encode(c *conn, out []byte) ([]byte, error) {
+	frame, err := c.codec.Encode(c, out)
+	if err != nil {
+		return nil, el.handleError(c, err)
+	}
+	return frame, nil
+}
+
+// Decode、Encode返回的致命错误交给ErrorHandler，没有实现时关闭连接，OnClosed收到err
+func (el *eventloop) handleError(c *conn, err error) error {
+	action := Close
+	if h, ok := el.eventHandler.(ErrorHandler); ok {
+		action = h.OnError(c, err)
+	}
+	switch action {
+	case Close:
+		return el.loopCloseConn(c, err)
+	case Shutdown:
+		return errServerShutdown
+	}
+	return nil
+}
+
 func (el *eventloop) loopRun() {
 	defer func() {
 		el.closeAllConns()
 		if el.idx == 0 && el.svr.opts.Ticker {
 			close(el.svr.ticktock)
 		}
-		// TODO why one loop exit leads to server shutdown?
+		// 走到这里说明收到了Shutdown，或者按LoopFailurePolicy不再重启，整个server都要停止
 		el.svr.signalShutdown()
 	}()
 
-	if el.idx == 0 && el.svr.opts.Ticker {
+	el.startTicker()
+
+	el.runPolling(func() error {
+		return el.poller.Polling(el.handleEvent)
+	})
+}
+
+// 运行polling直到eventloop需要停止：收到Shutdown或者server正在关闭时直接返回，
+// 其他错误按Options.LoopFailurePolicy决定是重新开始polling还是返回
+func (el *eventloop) runPolling(polling func() error) {
+	for {
+		err := polling()
+		if err == errServerShutdown || el.svr.inShutdown() || el.svr.opts.LoopFailurePolicy != RestartLoopOnFailure {
+			el.svr.logger.Printf("%s exits with error: %v\n", el, err)
+			return
+		}
+		el.svr.logger.Printf("%s exits with error: %v, restarting\n", el, err)
+	}
+}
+
+// 在eventloop goroutine开始polling之前调用
+func (el *eventloop) startTicker() {
+	if !el.svr.opts.Ticker {
+		return
+	}
+	if ticker, ok := el.eventHandler.(LoopTicker); ok {
+		el.startLoopTicker(ticker)
+		return
+	}
+	if el.idx == 0 {
 		go el.loopTicker()
 	}
+}
 
-	el.svr.logger.Printf("event-loop:%d exits with error: %v\n", el.idx, el.poller.Polling(el.handleEvent))
+// TickLoop由时间轮驱动，直接在eventloop goroutine中执行，不需要像loopTicker那样经过Trigger
+func (el *eventloop) startLoopTicker(ticker LoopTicker) {
+	t := &timer{loop: el}
+	t.f = func() error {
+		delay, action := ticker.TickLoop(el)
+		if action == Shutdown {
+			return errServerShutdown
+		}
+		el.addTimer(t, time.Now().Add(delay))
+		return nil
+	}
+	el.addTimer(t, time.Now())
+}
+
+func (el *eventloop) CountConnections() int {
+	return len(el.connections)
+}
+
+func (el *eventloop) Iterate(f func(c Conn) bool) {
+	for _, c := range el.connections {
+		if !f(c) {
+			return
+		}
+	}
 }
 
 func (el *eventloop) loopTicker() {
@@ -160,44 +446,112 @@ func (el *eventloop) handleAction(c *conn, action Action) error {
 }
 
 func (el *eventloop) loopOpen(c *conn) error {
-	c.opened = true
-	c.localAddr = el.svr.ln.lnaddr
-	c.remoteAddr = netpoll.SockaddrToTCPOrUnixAddr(c.sa)
-	out, action := el.eventHandler.OnOpened(c)
-	if el.svr.opts.TCPKeepAlive > 0 {
-		if _, ok := el.svr.ln.ln.(*net.TCPListener); ok {
+	// 在OnOpened、TLS握手写数据之前设置，握手完成回到这里时已经设置过了
+	if c.tls == nil || !c.tls.ready {
+		_, tcp := c.localAddr.(*net.TCPAddr)
+		if el.svr.opts.TCPKeepAlive > 0 && tcp {
 			_ = netpoll.SetKeepAlive(c.fd, int(el.svr.opts.TCPKeepAlive/time.Second))
 		}
+		if c.sockopts != nil {
+			c.sockopts.setConn(c.fd, tcp)
+		}
+	}
+	// TLS握手完成后再回到这里
+	if c.handshaking() {
+		return el.startHandshake(c)
+	}
+	c.opened = true
+	// Dial、Register的连接已经设置过地址
+	if c.remoteAddr == nil {
+		c.remoteAddr = netpoll.SockaddrToTCPOrUnixAddr(c.sa)
+	}
+	out, action := el.eventHandler.OnOpened(c)
+	if el.svr.opts.ReadTimeout > 0 || el.svr.opts.WriteTimeout > 0 || el.svr.opts.IdleTimeout > 0 {
+		c.lastRead = time.Now()
+		c.lastWrite = c.lastRead
 	}
 	if out != nil {
 		c.open(out)
 	}
+	el.scheduleTimeout(c)
 
-	// TODO
-	if !c.outboundBuffer.IsEmpty() {
-		_ = el.poller.AddWrite(c.fd)
+	// fd已经注册过可读事件，这里只能修改而不是再次添加，否则epoll会返回EEXIST
+	if c.pendingOutput() {
+		el.modEvents(c)
+		el.checkWatermarks(c)
 	}
 
 	return el.handleAction(c, action)
 }
 
 func (el *eventloop) loopRead(c *conn) error {
-	n, err := unix.Read(c.fd, el.packet)
-	if n == 0 || err != nil {
-		if err == unix.EAGAIN {
+	for {
+		n, err := el.poller.Read(c.fd, el.packet)
+		if n == 0 || err != nil {
+			if err == unix.EAGAIN {
+				return nil
+			}
+			if c.handshaking() {
+				return el.loopHandshakeEOF(c, err)
+			}
+			// n = 0 表示连接已关闭
+			return el.loopCloseConn(c, err)
+		}
+		el.touchRead(c)
+		if c.tls != nil {
+			if err = el.loopReadTLS(c, el.packet[:n]); err != nil || c.tls.closed {
+				return err
+			}
+		} else {
+			c.buffer = el.packet[:n]
+			if err = el.loopReact(c); err != nil || !c.opened {
+				return err
+			}
+			// el.packet会被下一次读覆盖，剩余的数据要拷贝到inboundBuffer
+			if err = el.saveInbound(c); err != nil || !c.opened {
+				return err
+			}
+		}
+
+		// 水平触发只读一次，剩余的数据会再次触发可读事件；
+		// 边缘触发必须读到EAGAIN，否则剩余的数据不会再有通知，暂停读时则等恢复后再读
+		if !el.svr.opts.EdgeTriggered || c.readingPaused() {
 			return nil
 		}
-		// n = 0 表示连接已关闭
-		return el.loopCloseConn(c, err)
 	}
-	c.buffer = el.packet[:n]
+}
 
-	for inFrame, _ := c.read(); inFrame != nil; inFrame, _ = c.read() {
+// 把收到的数据按codec解码成帧交给React，读被暂停时停下来，剩余的数据留给恢复之后处理
+func (el *eventloop) loopReact(c *conn) error {
+	for !c.readingPaused() {
+		inFrame, err := c.read()
+		if err != nil && !errors.Is(err, ErrIncompleteFrame) {
+			if err = el.handleError(c, err); err != nil || !c.opened {
+				return err
+			}
+			// 丢弃无法解码的数据，等读到新的数据再解码：有的错误和数据无关，继续解码只会一直出错
+			c.ResetBuffer()
+			return nil
+		}
+		if inFrame == nil {
+			return nil
+		}
+		if el.svr.reactPool != nil {
+			if err := el.submitReact(c, inFrame); err != nil || !c.opened {
+				return err
+			}
+			continue
+		}
 		out, action := el.eventHandler.React(inFrame, c)
 		if out != nil {
-			outFrame, _ := el.codec.Encode(c, out)
-			el.eventHandler.PreWrite()
-			c.write(outFrame)
+			outFrame, err := el.encode(c, out)
+			if err != nil || !c.opened {
+				return err
+			}
+			if outFrame != nil {
+				el.eventHandler.PreWrite()
+				c.write(outFrame)
+			}
 		}
 		switch action {
 		case None:
@@ -210,55 +564,89 @@ func (el *eventloop) loopRead(c *conn) error {
 			return nil
 		}
 	}
-	_, _ = c.inboundBuffer.Write(c.buffer)
 	return nil
 }
 
-func (el *eventloop) loopReadUDP(fd int) error {
-	n, sa , err := unix.Recvfrom(fd, el.packet, 0)
-	if err != nil || n == 0 {
-		if err != nil && err != unix.EAGAIN {
-			el.svr.logger.Printf("failed to read UDP packet from fd:%d, error:%v\n", fd, err)
+// loopReact之后c.buffer中剩下的数据存入inboundBuffer，超过MaxInboundBuffer时关闭连接
+func (el *eventloop) saveInbound(c *conn) error {
+	if limit := el.svr.opts.MaxInboundBuffer; limit > 0 {
+		if n := c.inboundBuffer.Length() + len(c.buffer); n > limit {
+			c.buffer = nil
+			return el.loopCloseConn(c, &FrameTooLargeError{Length: n, Limit: limit, Inbound: true})
 		}
-		return nil
 	}
-	c := newUDPConn(fd, el, sa)
-	out, action := el.eventHandler.React(el.packet[:n], c)
-	if out != nil {
-		el.eventHandler.PreWrite()
-		_ = c.sendTo(out)
+	_, _ = c.inboundBuffer.Write(c.buffer)
+	c.buffer = nil
+	return nil
+}
+
+func (el *eventloop) loopReadUDP(ln *listener) error {
+	fd := ln.fd
+	if el.oob == nil {
+		el.oob = make([]byte, netpoll.OOBSize)
 	}
-	switch action {
-	case Shutdown:
-		return errServerShutdown
+	for {
+		n, sa, info, err := netpoll.RecvMsg(fd, el.packet, el.oob)
+		if err != nil || n == 0 {
+			if err != nil && err != unix.EAGAIN && !el.svr.inShutdown() {
+				el.svr.logger.Printf("failed to read UDP packet from fd:%d, error:%v\n", fd, err)
+			}
+			return nil
+		}
+		c := newUDPConn(fd, ln, sa, info)
+		out, action := el.eventHandler.React(el.packet[:n], c)
+		if out != nil {
+			el.eventHandler.PreWrite()
+			_ = c.sendTo(out)
+		}
+		switch action {
+		case Shutdown:
+			return errServerShutdown
+		}
+
+		if !el.svr.opts.EdgeTriggered {
+			return nil
+		}
 	}
-	c.releaseUDP()
-	return nil
 }
 
 func (el *eventloop) loopAccept(fd int) error {
-	if fd == el.svr.ln.fd {
-		if el.svr.ln.pconn != nil {
-			return el.loopReadUDP(fd)
+	if ln := el.svr.listener(fd); ln != nil {
+		if ln.udp {
+			return el.loopReadUDP(ln)
 		}
 
-		nfd, sa, err := unix.Accept(fd)
-		if err != nil {
-			if err == unix.EAGAIN {
-				return nil
+		for {
+			nfd, sa, err := el.poller.Accept(fd)
+			if err != nil {
+				if err == unix.EAGAIN {
+					return nil
+				}
+				// 开始drain时listener已经关闭，不再监听它
+				if el.svr.inShutdown() {
+					_ = el.poller.Delete(fd)
+					return nil
+				}
+				return err
+			}
+			if el.svr.inShutdown() {
+				_ = unix.Close(nfd)
+				continue
+			}
+			if err = unix.SetNonblock(nfd, true); err != nil {
+				return err
+			}
+			c := el.svr.newAcceptedConn(nfd, el, sa, ln)
+			if err = el.poller.AddRead(nfd); err != nil {
+				return err
 			}
-			return err
-		}
-		if err = unix.SetNonblock(nfd, true); err != nil {
-			return err
-		}
-		c := newTCPConn(nfd, el, sa)
-		if err = el.poller.AddRead(nfd); err == nil {
 			el.connections[c.fd] = c
 			el.calibrateCallback(el, 1)
-			return el.loopOpen(c)
+			// 边缘触发下listener上可能堆积了多个连接，需要一直accept到EAGAIN
+			if err = el.loopOpen(c); err != nil || !el.svr.opts.EdgeTriggered {
+				return err
+			}
 		}
-		return err
 	}
 	return nil
 }
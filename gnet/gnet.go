@@ -1,15 +1,14 @@
 package gnet
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
 	"net"
 	"os"
-	"runtime"
 	"strings"
 	"sync/atomic"
 	"time"
-
-	"golang_project_note/gnet/internal/netpoll"
 )
 
 // event的每个步骤结束后将进行的操作
@@ -34,8 +33,10 @@ type Server struct {
 	svr *server
 	// 是否启用多核，将决定reactor的数量，如果启用则需要注意事件回调之间共享的数据同步
 	Multicore bool
-	// 服务监听地址
+	// 服务监听地址，即传给Start的地址
 	Addr net.Addr
+	// 所有listener的监听地址，第一个和Addr相同
+	Addrs []net.Addr
 	// reactor数量
 	NumEventLoop int
 	// SO_REUSEPORT：支持多个进程/线程绑定到同一端口，这样就不用listen同一个socket
@@ -60,7 +61,8 @@ type Conn interface {
 
 	// Read reads all data from inbound ring-buffer and event-loop-buffer without moving "read" pointer, which means
 	// it does not evict the data from buffers actually and those data will present in buffers until the
-	// ResetBuffer method is called.
+	// ResetBuffer method is called. The returned buf is only valid until the next Read or ReadN call, while the frame
+	// passed to React stays valid until React returns even if React calls Read, ReadN, ShiftN or ResetBuffer.
 	Read() (buf []byte)
 
 	// ResetBuffer resets the buffers, which means all data in inbound ring-buffer and event-loop-buffer will be evicted.
@@ -86,14 +88,125 @@ type Conn interface {
 	SendTo(buf []byte) error
 
 	// AsyncWrite writes data to client/connection asynchronously, usually you would call it in individual goroutines
-	// instead of the event-loop goroutines.
+	// instead of the event-loop goroutines. It returns ErrOutboundBufferFull instead of buffering the data if that
+	// would exceed Options.MaxOutboundBuffer.
 	AsyncWrite(buf []byte) error
 
+	// Writev writes multiple buffers to the connection in one writev(2) call, together with the data already
+	// pending in the outbound buffer, e.g. a header and a payload without concatenating them. The buffers are
+	// written as they are, the codec is not applied. It must be called in the event-loop goroutine.
+	Writev(bufs [][]byte) error
+
+	// AsyncWritev is like Writev but can be called in individual goroutines, the buffers must not be modified
+	// until they are written. Like AsyncWrite, it is limited by Options.MaxOutboundBuffer.
+	AsyncWritev(bufs [][]byte) error
+
+	// SendFile sends count bytes of f starting at offset with sendfile(2), after the data already written to the
+	// connection and before the data written later. The file is dup'ed so f can be closed once SendFile returns.
+	// It must be called in the event-loop goroutine.
+	SendFile(f *os.File, offset, count int64) error
+
 	// Wake triggers a React event for this connection.
 	Wake() error
 
 	// Close closes the current connection.
 	Close() error
+
+	// SetDeadline sets the read and write deadlines associated with the connection, it is equivalent to calling
+	// both SetReadDeadline and SetWriteDeadline. A zero value for t means the connection will not time out.
+	// Like the other methods except AsyncWrite and Wake, it must be called in the event-loop goroutine, e.g. in
+	// OnOpened or React.
+	SetDeadline(t time.Time) error
+
+	// SetReadDeadline sets the deadline for receiving data, the connection will be closed with ErrReadTimeout
+	// once it is reached, call it again in React to extend it.
+	SetReadDeadline(t time.Time) error
+
+	// SetWriteDeadline sets the deadline for flushing the outbound buffer, the connection will be closed with
+	// ErrWriteTimeout if there is still pending data when it is reached.
+	SetWriteDeadline(t time.Time) error
+
+	// AfterFunc calls f with this connection in the event-loop goroutine after duration d, f will not be called
+	// if the connection has been closed by then. It must be called in the event-loop goroutine.
+	AfterFunc(d time.Duration, f func(c Conn)) Timer
+
+	// EventLoop returns the event-loop this connection belongs to.
+	EventLoop() EventLoop
+
+	// PauseRead stops the event-loop from reading the connection until ResumeRead is called, data that has been
+	// read but not yet handled stays in the inbound buffer. React will not be called for the connection once
+	// PauseRead returns, except the call in progress. Both can be called in any goroutine, the last call wins.
+	PauseRead() error
+
+	// ResumeRead resumes reading the connection paused by PauseRead, the frames left in the inbound buffer are
+	// handled first. Reading stays paused while the outbound buffer is above its high watermark.
+	ResumeRead() error
+
+	// SetOutboundWatermarks overrides Options.OutboundLowWatermark and Options.OutboundHighWatermark for this
+	// connection, a high watermark of 0 disables back-pressure. It must be called in the event-loop goroutine.
+	SetOutboundWatermarks(low, high int)
+
+	// TLSConnectionState returns the state of the TLS connection once the handshake has completed, including the
+	// protocol negotiated by ALPN and the server name sent by the client (SNI). It returns nil if Options.TLSConfig
+	// is not set for the connection, and must be called in the event-loop goroutine.
+	TLSConnectionState() *tls.ConnectionState
+}
+
+// EventLoop代表一个eventloop，方法只能在该eventloop goroutine中调用，所以不需要加锁
+type EventLoop interface {
+	// Index returns the index of the event-loop in the server.
+	Index() int
+
+	// Schedule calls fn in the event-loop goroutine after duration d, the returned Timer can be used to cancel it.
+	// Thousands of timers per event-loop are cheap, they share one timing wheel.
+	Schedule(d time.Duration, fn func()) Timer
+}
+
+// EventLoopInfo是传给LoopTicker.TickLoop的eventloop，只能在TickLoop中使用
+type EventLoopInfo interface {
+	EventLoop
+
+	// CountConnections returns the number of connections on the event-loop.
+	CountConnections() int
+
+	// Iterate calls f for each connection on the event-loop until f returns false.
+	Iterate(f func(c Conn) bool)
+}
+
+// Engine是Start返回的、正在运行的server的句柄
+type Engine struct {
+	svr *server
+}
+
+// Addr返回传给Start的地址实际监听的地址，监听端口0时可以通过它拿到系统分配的端口，NewClient的Engine返回nil
+func (e *Engine) Addr() net.Addr {
+	if len(e.svr.lns) == 0 {
+		return nil
+	}
+	return e.svr.lns[0].lnaddr
+}
+
+// Addrs按Start的addr、Options.Listeners的顺序返回所有listener实际监听的地址
+func (e *Engine) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(e.svr.lns))
+	for i, ln := range e.svr.lns {
+		addrs[i] = ln.lnaddr
+	}
+	return addrs
+}
+
+func (e *Engine) CountConnections() int {
+	return Server{svr: e.svr}.CountConnections()
+}
+
+// Done在server完全停止（所有eventloop退出、OnShutdown调用完毕）后关闭
+func (e *Engine) Done() <-chan struct{} {
+	return e.svr.done
+}
+
+// Stop与gnet.Stop相同：不再接收新连接，等待outboundBuffer发送完毕，ctx结束时强制关闭
+func (e *Engine) Stop(ctx context.Context) error {
+	return e.svr.stopGracefully(ctx)
 }
 
 func (s Server) CountConnections() (count int) {
@@ -113,7 +226,8 @@ type (
 		// accept一个新连接后调用
 		// 可以返回些数据给client
 		OnOpened(c Conn) (out []byte, action Action)
-		// 连接被关闭时调用
+		// 连接被关闭时调用。Dial的连接connect失败、TLS连接握手失败时也会调用，
+		// 这时没有调用过OnOpened，err是失败的原因
 		OnClosed(c Conn, err error) (action Action)
 		// 在数据写入socket之前调用
 		// 通常用于日志、数据上报
@@ -123,6 +237,26 @@ type (
 		// 定时任务
 		Tick() (delay time.Duration, action Action)
 	}
+	// EventHandler可以选择实现的接口，开启Ticker后每个eventloop都会在自己的goroutine中调用TickLoop，
+	// 可以直接访问该eventloop上的连接，不需要加锁；实现了LoopTicker时不再调用Tick
+	LoopTicker interface {
+		// 返回下一次调用的间隔
+		TickLoop(loop EventLoopInfo) (delay time.Duration, action Action)
+	}
+	// EventHandler可以选择实现的接口，在eventloop goroutine中调用
+	BackpressureHandler interface {
+		// outboundBuffer超过高水位时调用，此时这个连接已经暂停读
+		OnBackpressure(c Conn)
+		// outboundBuffer降到低水位及以下、恢复读之后调用
+		OnWritable(c Conn)
+	}
+	// EventHandler可以选择实现的接口，在eventloop goroutine中调用
+	ErrorHandler interface {
+		// codec的Decode、Encode返回致命错误（不是ErrIncompleteFrame）时调用。
+		// 返回None时丢弃出错的数据：Decode时是已经收到、还没解码的全部数据，Encode时是这次要写出的数据，连接继续使用；
+		// 返回Close时关闭连接，OnClosed收到err。没有实现ErrorHandler时按Close处理
+		OnError(c Conn, err error) (action Action)
+	}
 	EventServer struct {
 	}
 )
@@ -153,69 +287,84 @@ func (es *EventServer) Tick() (delay time.Duration, action Action) {
 	return
 }
 
-// Serve开始处理指定地址的事件
-func Serve(eventHandler EventHandler, addr string, opts ...Option) (err error) {
-	var ln listener
-	defer func() {
-		ln.close()
-		if ln.network == "unix" {
-			// 删除socket文件
-			sniffErrorAndLog(os.RemoveAll(ln.addr))
-		}
-	}()
+// Serve开始处理指定地址的事件，会一直阻塞到server停止
+func Serve(eventHandler EventHandler, addr string, opts ...Option) error {
+	engine, err := Start(eventHandler, addr, opts...)
+	if err != nil {
+		return err
+	}
+	<-engine.Done()
+	return nil
+}
 
+// Start在listener和所有eventloop都启动之后立即返回，之后通过返回的Engine来管理server。
+// 除了addr，还会监听Options.Listeners中的地址，所有listener共享同一组eventloop和负载均衡
+func Start(eventHandler EventHandler, addr string, opts ...Option) (engine *Engine, err error) {
 	options := loadOptions(opts...)
 	if options.Logger != nil {
 		defaultLogger = options.Logger
 	}
 
-	ln.network, ln.addr = parseAddr(addr)
-	switch ln.network {
-	case "udp", "udp4", "udp6":
-		if options.ReusePort {
-			ln.pconn, err = netpoll.ReusePortListenPacket(ln.network, ln.addr)
-		} else {
-			ln.pconn, err = net.ListenPacket(ln.network, ln.addr)
-		}
-	case "unix":
-		sniffErrorAndLog(os.RemoveAll(ln.addr))
-		if runtime.GOOS == "windows" {
-			return ErrUnsupportedPlatform
+	var lns []*listener
+	defer func() {
+		// 启动成功后listener由server在停止时关闭
+		if err != nil {
+			for _, ln := range lns {
+				ln.close()
+			}
 		}
-		fallthrough
-	case "tcp", "tcp4", "tcp6":
-		if options.ReusePort {
-			ln.ln, err = netpoll.ReusePortListen(ln.network, ln.addr)
-		} else {
-			ln.ln, err = net.Listen(ln.network, ln.addr)
+	}()
+	configs := append([]ListenerConfig{{Addr: addr}}, options.Listeners...)
+	for _, config := range configs {
+		var ln *listener
+		if ln, err = listen(config, options); err != nil {
+			return
 		}
-	default:
-		err = ErrUnsupportedProtocol
+		lns = append(lns, ln)
 	}
-	if err != nil {
+
+	var svr *server
+	if svr, err = startServer(eventHandler, lns, options); err != nil {
 		return
 	}
+	return &Engine{svr: svr}, nil
+}
 
-	if ln.pconn != nil {
-		ln.lnaddr = ln.pconn.LocalAddr()
-	} else {
-		ln.lnaddr = ln.ln.Addr()
+func listen(config ListenerConfig, options *Options) (*listener, error) {
+	ln := &listener{protoAddr: config.Addr, codec: config.Codec, sockopts: &options.SocketOptions}
+	if config.SocketOptions != nil {
+		ln.sockopts = config.SocketOptions
 	}
-
-	if err = ln.renormalize(); err != nil {
-		return
+	if err := ln.sockopts.validate(); err != nil {
+		return nil, err
 	}
+	ln.network, ln.addr = parseAddr(config.Addr)
+	// 出错时listen已经关闭了socket
+	if err := ln.listen(options.ReusePort); err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
 
-	return serve(eventHandler, &ln, options)
+// Stop优雅地停止在protoAddr（即传给Serve的地址或者Options.Listeners中的地址）上运行的server：
+// 不再接收新连接，等待所有连接的outboundBuffer发送完毕后关闭，
+// 如果ctx先结束则强制关闭所有连接，并返回ctx.Err()
+func Stop(ctx context.Context, protoAddr string) error {
+	v, ok := allServers.Load(protoAddr)
+	if !ok {
+		return ErrServerNotFound
+	}
+	return v.(*server).stopGracefully(ctx)
 }
 
 // tcp://192.168.0.1:80
 func parseAddr(addr string) (network, address string) {
 	network = "tcp"
-	address = strings.ToLower(addr)
+	address = addr
+	// unix socket的路径区分大小写，只有协议部分转成小写
 	if strings.Contains(address, "://") {
-		pair := strings.Split(address, "://")
-		network = pair[0]
+		pair := strings.SplitN(address, "://", 2)
+		network = strings.ToLower(pair[0])
 		address = pair[1]
 	}
 	return
@@ -7,21 +7,39 @@ package gnet
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/valyala/bytebufferpool"
+	"golang.org/x/sys/unix"
 	"golang_project_note/gnet/pool/bytebuffer"
 	"golang_project_note/gnet/pool/goroutine"
+	prb "golang_project_note/gnet/pool/ringbuffer"
 )
 
 func TestCodecServe(t *testing.T) {
@@ -395,6 +413,87 @@ func TestServe(t *testing.T) {
 	})
 }
 
+func TestServeEdgeTriggered(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		t.Run("tcp", func(t *testing.T) {
+			t.Run("1-loop", func(t *testing.T) {
+				testServe("tcp", ":9991", false, false, false, 10, RoundRobin, WithEdgeTriggered(true))
+			})
+			t.Run("N-loop", func(t *testing.T) {
+				testServe("tcp", ":9992", false, true, false, 10, LeastConnections, WithEdgeTriggered(true))
+			})
+		})
+		t.Run("tcp-async", func(t *testing.T) {
+			t.Run("1-loop", func(t *testing.T) {
+				testServe("tcp", ":9991", false, false, true, 10, RoundRobin, WithEdgeTriggered(true))
+			})
+			t.Run("N-loop", func(t *testing.T) {
+				testServe("tcp", ":9992", false, true, true, 10, LeastConnections, WithEdgeTriggered(true))
+			})
+		})
+		t.Run("udp", func(t *testing.T) {
+			t.Run("1-loop", func(t *testing.T) {
+				testServe("udp", ":9991", false, false, false, 10, RoundRobin, WithEdgeTriggered(true))
+			})
+		})
+		t.Run("unix", func(t *testing.T) {
+			t.Run("N-loop", func(t *testing.T) {
+				testServe("unix", "gnet2.sock", false, true, false, 10, SourceAddrHash, WithEdgeTriggered(true))
+			})
+		})
+	})
+	t.Run("poll-reuseport", func(t *testing.T) {
+		t.Run("tcp", func(t *testing.T) {
+			t.Run("N-loop", func(t *testing.T) {
+				testServe("tcp", ":9992", true, true, false, 10, LeastConnections, WithEdgeTriggered(true))
+			})
+		})
+		t.Run("unix", func(t *testing.T) {
+			t.Run("N-loop", func(t *testing.T) {
+				testServe("unix", "gnet2.sock", true, true, false, 10, LeastConnections, WithEdgeTriggered(true))
+			})
+		})
+	})
+}
+
+func TestServeIOUring(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		t.Run("tcp", func(t *testing.T) {
+			t.Run("1-loop", func(t *testing.T) {
+				testServe("tcp", ":9991", false, false, false, 10, RoundRobin, WithIOUring(true))
+			})
+			t.Run("N-loop", func(t *testing.T) {
+				testServe("tcp", ":9992", false, true, false, 10, LeastConnections, WithIOUring(true))
+			})
+		})
+		t.Run("tcp-async", func(t *testing.T) {
+			t.Run("1-loop", func(t *testing.T) {
+				testServe("tcp", ":9991", false, false, true, 10, RoundRobin, WithIOUring(true))
+			})
+			t.Run("N-loop", func(t *testing.T) {
+				testServe("tcp", ":9992", false, true, true, 10, LeastConnections, WithIOUring(true))
+			})
+		})
+		t.Run("udp", func(t *testing.T) {
+			t.Run("1-loop", func(t *testing.T) {
+				testServe("udp", ":9991", false, false, false, 10, RoundRobin, WithIOUring(true))
+			})
+		})
+		t.Run("unix", func(t *testing.T) {
+			t.Run("N-loop", func(t *testing.T) {
+				testServe("unix", "gnet2.sock", false, true, false, 10, SourceAddrHash, WithIOUring(true))
+			})
+		})
+	})
+	t.Run("poll-reuseport", func(t *testing.T) {
+		t.Run("tcp", func(t *testing.T) {
+			t.Run("N-loop", func(t *testing.T) {
+				testServe("tcp", ":9992", true, true, false, 10, LeastConnections, WithIOUring(true))
+			})
+		})
+	})
+}
+
 type testServer struct {
 	*EventServer
 	svr          Server
@@ -495,7 +594,7 @@ func (s *testServer) Tick() (delay time.Duration, action Action) {
 	return
 }
 
-func testServe(network, addr string, reuseport, multicore, async bool, nclients int, lb LoadBalancing) {
+func testServe(network, addr string, reuseport, multicore, async bool, nclients int, lb LoadBalancing, opts ...Option) {
 	ts := &testServer{
 		network:    network,
 		addr:       addr,
@@ -503,8 +602,9 @@ func testServe(network, addr string, reuseport, multicore, async bool, nclients
 		async:      async,
 		nclients:   nclients,
 		workerPool: goroutine.Default()}
-	must(Serve(ts, network+"://"+addr, WithMulticore(multicore), WithReusePort(reuseport), WithTicker(true),
-		WithTCPKeepAlive(time.Minute*1), WithLoadBalancing(lb)))
+	opts = append([]Option{WithMulticore(multicore), WithReusePort(reuseport), WithTicker(true),
+		WithTCPKeepAlive(time.Minute * 1), WithLoadBalancing(lb)}, opts...)
+	must(Serve(ts, network+"://"+addr, opts...))
 }
 
 func startClient(network, addr string, multicore, async bool) {
@@ -550,6 +650,64 @@ func startClient(network, addr string, multicore, async bool) {
 	}
 }
 
+func BenchmarkEcho(b *testing.B) {
+	b.Run("level-triggered", func(b *testing.B) {
+		benchmarkEcho(b, "tcp", ":9981", false)
+	})
+	b.Run("edge-triggered", func(b *testing.B) {
+		benchmarkEcho(b, "tcp", ":9982", true)
+	})
+}
+
+type benchEchoServer struct {
+	*EventServer
+	ready chan struct{}
+}
+
+func (s *benchEchoServer) OnInitComplete(svr Server) (action Action) {
+	close(s.ready)
+	return
+}
+func (s *benchEchoServer) OnClosed(c Conn, err error) (action Action) {
+	action = Shutdown
+	return
+}
+func (s *benchEchoServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	out = frame
+	return
+}
+
+func benchmarkEcho(b *testing.B, network, addr string, et bool) {
+	svr := &benchEchoServer{ready: make(chan struct{})}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Serve(svr, network+"://"+addr, WithEdgeTriggered(et))
+	}()
+	<-svr.ready
+
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// 比el.packet更大，水平触发需要多次可读事件才能读完
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	data2 := make([]byte, len(data))
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = c.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if _, err = io.ReadFull(c, data2); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	_ = c.Close()
+	must(<-errCh)
+}
+
 func must(err error) {
 	if err != nil && err != ErrUnsupportedProtocol {
 		panic(err)
@@ -981,3 +1139,2826 @@ func testCloseConnection(network, addr string) {
 	events := &testCloseConnectionServer{network: network, addr: addr}
 	must(Serve(events, network+"://"+addr, WithTicker(true)))
 }
+
+func TestStop(t *testing.T) {
+	t.Run("graceful", func(t *testing.T) {
+		testStop(t, "tcp", ":9991", false)
+	})
+	t.Run("graceful-reuseport", func(t *testing.T) {
+		testStop(t, "tcp", ":9992", true)
+	})
+	t.Run("force", func(t *testing.T) {
+		testStopForce(t, "tcp", ":9993")
+	})
+	if err := Stop(context.Background(), "tcp://:9994"); err != ErrServerNotFound {
+		t.Fatalf("expected ErrServerNotFound, got %v", err)
+	}
+}
+
+type testStopServer struct {
+	*EventServer
+	opened chan struct{}
+	closed int32
+	// OnOpened返回的数据大小，大于socket缓冲区时需要eventloop多次发送
+	size int
+}
+
+func (s *testStopServer) OnOpened(c Conn) (out []byte, action Action) {
+	out = make([]byte, s.size)
+	s.opened <- struct{}{}
+	return
+}
+func (s *testStopServer) OnClosed(c Conn, err error) (action Action) {
+	atomic.AddInt32(&s.closed, 1)
+	return
+}
+
+// drain期间listener已经关闭，新连接被拒绝，而不是accept之后马上关闭
+func TestStopRefuseWhileDraining(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testStopRefuseWhileDraining(t)
+	})
+	t.Run("poll-reuseport", func(t *testing.T) {
+		testStopRefuseWhileDraining(t, WithReusePort(true))
+	})
+	t.Run("io_uring", func(t *testing.T) {
+		testStopRefuseWhileDraining(t, WithIOUring(true))
+	})
+}
+
+func testStopRefuseWhileDraining(t *testing.T, opts ...Option) {
+	// 客户端不读，greeting一直发不完，drain要等客户端开始读
+	events := &testTimeoutServer{greeting: make([]byte, 8*1024*1024), closed: make(chan error, 1)}
+	engine, err := Start(events, "tcp://127.0.0.1:0", append(opts, WithDisableSignalNotify(true))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := engine.Addr().String()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 等连接被accept，还在backlog中的连接会在listener关闭时被重置
+	first := make([]byte, 1)
+	if _, err = io.ReadFull(conn, first); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		stopped <- engine.Stop(ctx)
+	}()
+	for !engine.svr.inShutdown() {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; ; i++ {
+		nc, err := net.Dial("tcp", addr)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			break
+		}
+		if err == nil {
+			_ = nc.Close()
+		}
+		if i == 100 {
+			t.Fatalf("expected ECONNREFUSED while draining, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n, _ := io.Copy(ioutil.Discard, conn); n != int64(len(events.greeting)-1) {
+		t.Fatalf("expected %d bytes flushed before closing, got %d", len(events.greeting)-1, n+1)
+	}
+	if err = <-stopped; err != nil {
+		t.Fatalf("expected graceful stop, got %v", err)
+	}
+}
+
+func testStop(t *testing.T, network, addr string, reuseport bool) {
+	events := &testStopServer{opened: make(chan struct{}, 1), size: 8 * 1024 * 1024}
+	engine, err := Start(events, network+"://"+addr, WithReusePort(reuseport), WithDisableSignalNotify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-events.opened
+
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, conn)
+		received <- n
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = Stop(ctx, network+"://"+addr); err != nil {
+		t.Fatalf("expected graceful stop, got %v", err)
+	}
+	<-engine.Done()
+	if n := <-received; n != int64(events.size) {
+		t.Fatalf("expected %d bytes flushed before closing, got %d", events.size, n)
+	}
+	if atomic.LoadInt32(&events.closed) != 1 {
+		t.Fatal("did not call close on the connection")
+	}
+
+	// 已经停止的server不能再次Stop，新连接也会被拒绝
+	if err = Stop(ctx, network+"://"+addr); err != ErrServerNotFound {
+		t.Fatalf("expected ErrServerNotFound, got %v", err)
+	}
+	if _, err = net.Dial(network, addr); err == nil {
+		t.Fatal("expected listener to be closed")
+	}
+}
+
+func testStopForce(t *testing.T, network, addr string) {
+	events := &testStopServer{opened: make(chan struct{}, 1), size: 8 * 1024 * 1024}
+	engine, err := Start(events, network+"://"+addr, WithDisableSignalNotify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-events.opened
+
+	// 客户端不读数据，outboundBuffer永远发不完
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = engine.Stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	select {
+	case <-engine.Done():
+	default:
+		t.Fatal("expected engine to be done after Stop returns")
+	}
+	if atomic.LoadInt32(&events.closed) != 1 {
+		t.Fatal("did not call close on the connection")
+	}
+}
+
+func TestStart(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		testStart(t, "tcp", "127.0.0.1:0", false)
+	})
+	t.Run("tcp-N-loop", func(t *testing.T) {
+		testStart(t, "tcp", "127.0.0.1:0", true)
+	})
+	t.Run("unix", func(t *testing.T) {
+		testStart(t, "unix", "gnet1.sock", false)
+	})
+}
+
+type testStartServer struct {
+	*EventServer
+	shutdown int32
+}
+
+func (s *testStartServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	out = frame
+	return
+}
+func (s *testStartServer) OnShutdown(svr Server) {
+	atomic.StoreInt32(&s.shutdown, 1)
+}
+
+func testStart(t *testing.T, network, addr string, multicore bool) {
+	events := new(testStartServer)
+	engine, err := Start(events, network+"://"+addr, WithMulticore(multicore), WithDisableSignalNotify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnaddr := engine.Addr()
+	if tcpAddr, ok := lnaddr.(*net.TCPAddr); ok && tcpAddr.Port == 0 {
+		t.Fatalf("expected the bound port, got %v", lnaddr)
+	}
+
+	// Start返回时已经可以处理连接了，不需要sleep
+	conn, err := net.Dial(lnaddr.Network(), lnaddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("Hello World!")
+	if _, err = conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	if n := engine.CountConnections(); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+	_ = conn.Close()
+
+	if err = engine.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-engine.Done()
+	if atomic.LoadInt32(&events.shutdown) != 1 {
+		t.Fatal("did not call OnShutdown")
+	}
+	if err = engine.Stop(context.Background()); err != ErrServerInShutdown {
+		t.Fatalf("expected ErrServerInShutdown, got %v", err)
+	}
+}
+
+type testTickShutdownServer struct {
+	*EventServer
+}
+
+func (s *testTickShutdownServer) Tick() (delay time.Duration, action Action) {
+	return 0, Shutdown
+}
+
+// eventloop启动后立刻要求关闭，shutdown信号会在stop()开始等待之前发出，不能丢失
+func TestShutdownBeforeWait(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		engine, err := Start(new(testTickShutdownServer), "tcp://127.0.0.1:0",
+			WithTicker(true), WithMulticore(true), WithDisableSignalNotify(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-engine.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("round %d: server did not stop after Tick returned Shutdown", i)
+		}
+		if state := atomic.LoadInt32(&engine.svr.state); state != stateStopped {
+			t.Fatalf("expected state stopped, got %d", state)
+		}
+	}
+}
+
+func TestLifecycleState(t *testing.T) {
+	engine, err := Start(new(testStartServer), "tcp://127.0.0.1:0", WithDisableSignalNotify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := atomic.LoadInt32(&engine.svr.state); state != stateRunning {
+		t.Fatalf("expected state running, got %d", state)
+	}
+	// 多次signalShutdown不会panic，也不会丢失
+	engine.svr.signalShutdown()
+	engine.svr.signalShutdown()
+	<-engine.Done()
+	if state := atomic.LoadInt32(&engine.svr.state); state != stateStopped {
+		t.Fatalf("expected state stopped, got %d", state)
+	}
+	if err = engine.Stop(context.Background()); err != ErrServerInShutdown {
+		t.Fatalf("expected ErrServerInShutdown, got %v", err)
+	}
+}
+
+func TestLoopFailurePolicy(t *testing.T) {
+	t.Run("shutdown", func(t *testing.T) {
+		testLoopFailurePolicy(t, ShutdownOnLoopFailure)
+	})
+	t.Run("restart", func(t *testing.T) {
+		testLoopFailurePolicy(t, RestartLoopOnFailure)
+	})
+}
+
+func testLoopFailurePolicy(t *testing.T, policy LoopFailurePolicy) {
+	engine, err := Start(new(testStartServer), "tcp://127.0.0.1:0",
+		WithNumEventLoop(2), WithLoopFailurePolicy(policy), WithDisableSignalNotify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo := func() error {
+		data := []byte("Hello World!")
+		if _, err := conn.Write(data); err != nil {
+			return err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := io.ReadFull(conn, data)
+		return err
+	}
+	if err = echo(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 让所有eventloop都因为错误退出，出错的任务之后的任务不能丢
+	executed := make(chan struct{}, engine.svr.subEventLoopSet.len())
+	engine.svr.subEventLoopSet.iterate(func(i int, el *eventloop) bool {
+		_ = el.poller.Trigger(func() error {
+			return errors.New("injected failure")
+		})
+		_ = el.poller.Trigger(func() error {
+			executed <- struct{}{}
+			return nil
+		})
+		return true
+	})
+
+	switch policy {
+	case ShutdownOnLoopFailure:
+		select {
+		case <-engine.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected server to stop after an eventloop failed")
+		}
+	case RestartLoopOnFailure:
+		for i := engine.svr.subEventLoopSet.len(); i > 0; i-- {
+			select {
+			case <-executed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("jobs queued after the failure were not executed")
+			}
+		}
+		select {
+		case <-engine.Done():
+			t.Fatal("expected server to keep running after the eventloop restarted")
+		default:
+		}
+		// 连接被保留，仍然可以正常读写
+		if err = echo(); err != nil {
+			t.Fatal(err)
+		}
+		if err = engine.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		<-engine.Done()
+	}
+}
+
+type testTimeoutServer struct {
+	*EventServer
+	// OnOpened中写出的数据
+	greeting     []byte
+	readDeadline time.Duration
+	closed       chan error
+}
+
+func (s *testTimeoutServer) OnOpened(c Conn) (out []byte, action Action) {
+	if s.readDeadline > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(s.readDeadline))
+	}
+	return s.greeting, None
+}
+
+func (s *testTimeoutServer) OnClosed(c Conn, err error) (action Action) {
+	s.closed <- err
+	return
+}
+
+func (s *testTimeoutServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	if s.readDeadline > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(s.readDeadline))
+	}
+	out = frame
+	return
+}
+
+func TestConnTimeout(t *testing.T) {
+	t.Run("idle", func(t *testing.T) {
+		testConnTimeout(t, &testTimeoutServer{}, ErrIdleTimeout, WithIdleTimeout(100*time.Millisecond))
+	})
+	t.Run("read", func(t *testing.T) {
+		testConnTimeout(t, &testTimeoutServer{}, ErrReadTimeout, WithReadTimeout(100*time.Millisecond))
+	})
+	t.Run("write", func(t *testing.T) {
+		// 客户端不读数据，outboundBuffer一直发不完
+		testConnTimeout(t, &testTimeoutServer{greeting: make([]byte, 8*1024*1024)}, ErrWriteTimeout,
+			WithWriteTimeout(100*time.Millisecond))
+	})
+	t.Run("write-io_uring", func(t *testing.T) {
+		testConnTimeout(t, &testTimeoutServer{greeting: make([]byte, 8*1024*1024)}, ErrWriteTimeout,
+			WithWriteTimeout(100*time.Millisecond), WithIOUring(true))
+	})
+	t.Run("read-deadline", func(t *testing.T) {
+		testConnTimeout(t, &testTimeoutServer{readDeadline: 100 * time.Millisecond}, ErrReadTimeout)
+	})
+	t.Run("active", func(t *testing.T) {
+		testConnTimeoutActive(t)
+	})
+}
+
+func testConnTimeout(t *testing.T, events *testTimeoutServer, expected error, opts ...Option) {
+	events.closed = make(chan error, 1)
+	engine, err := Start(events, "tcp://127.0.0.1:0", append(opts, WithDisableSignalNotify(true))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	select {
+	case err = <-events.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not time out")
+	}
+	if err != expected {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("connection timed out too early: %v", elapsed)
+	}
+}
+
+// 连接一直有数据往来时不会超时
+func testConnTimeoutActive(t *testing.T) {
+	events := &testTimeoutServer{readDeadline: 200 * time.Millisecond, closed: make(chan error, 1)}
+	engine, err := Start(events, "tcp://127.0.0.1:0", WithIdleTimeout(200*time.Millisecond),
+		WithReadTimeout(200*time.Millisecond), WithDisableSignalNotify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := []byte("ping")
+	for i := 0; i < 10; i++ {
+		if _, err = conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(conn, data); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case err = <-events.closed:
+		t.Fatalf("active connection was closed: %v", err)
+	default:
+	}
+}
+
+// 每次都推进到next()返回的时间，定时器应该恰好在到期的tick触发，不会提前也不会推迟
+func TestTimingWheel(t *testing.T) {
+	base := time.Unix(0, 0)
+	w := newTimingWheel(base)
+	const n = 10000
+	timers := make([]*timer, n)
+	fired := 0
+	for i := range timers {
+		// 覆盖每一层，以及超出时间轮范围的情况
+		d := time.Duration(rand.Int63n(int64(2*wheelRange))) * wheelTick
+		if i%4 == 0 {
+			d = time.Duration(rand.Intn(1000)) * wheelTick
+		}
+		timers[i] = &timer{}
+		w.add(timers[i], base.Add(d))
+	}
+	// 随机取消一部分
+	stopped := 0
+	for i := 0; i < n; i += 7 {
+		if !w.del(timers[i]) {
+			t.Fatal("expected pending timer to be stopped")
+		}
+		stopped++
+	}
+	for {
+		now, ok := w.next()
+		if !ok {
+			break
+		}
+		w.advance(now)
+		for tm := w.expired.head; tm != nil; tm = w.expired.head {
+			w.expired.remove(tm)
+			if tm.expires != w.cur {
+				t.Fatalf("timer expiring at tick %d fired at tick %d", tm.expires, w.cur)
+			}
+			fired++
+		}
+	}
+	if fired+stopped != n {
+		t.Fatalf("expected %d timers to fire, got %d", n-stopped, fired)
+	}
+}
+
+type testTimerServer struct {
+	*EventServer
+	fired  chan string
+	closed chan struct{}
+}
+
+func (s *testTimerServer) OnOpened(c Conn) (out []byte, action Action) {
+	cancelled := c.AfterFunc(50*time.Millisecond, func(c Conn) {
+		s.fired <- "cancelled"
+	})
+	c.AfterFunc(100*time.Millisecond, func(c Conn) {
+		s.fired <- "conn"
+		_ = c.Close()
+	})
+	// 关闭连接之后才到期，不会被调用
+	c.AfterFunc(300*time.Millisecond, func(c Conn) {
+		s.fired <- "closed"
+	})
+	c.EventLoop().Schedule(10*time.Millisecond, func() {
+		if !cancelled.Stop() {
+			s.fired <- "stop failed"
+		}
+		s.fired <- "loop"
+	})
+	return
+}
+
+func (s *testTimerServer) OnClosed(c Conn, err error) (action Action) {
+	close(s.closed)
+	return
+}
+
+func TestTimer(t *testing.T) {
+	events := &testTimerServer{fired: make(chan string, 10), closed: make(chan struct{})}
+	engine, err := Start(events, "tcp://127.0.0.1:0", WithDisableSignalNotify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-events.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed by AfterFunc")
+	}
+	time.Sleep(400 * time.Millisecond)
+	close(events.fired)
+	var order []string
+	for name := range events.fired {
+		order = append(order, name)
+	}
+	if len(order) != 2 || order[0] != "loop" || order[1] != "conn" {
+		t.Fatalf("unexpected timers fired: %v", order)
+	}
+}
+
+func BenchmarkTimingWheel(b *testing.B) {
+	w := newTimingWheel(time.Now())
+	timers := make([]timer, 4096)
+	now := w.base
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tm := &timers[i%len(timers)]
+		w.add(tm, now.Add(time.Duration(i%60000)*wheelTick))
+		if i%len(timers) == len(timers)-1 {
+			now = now.Add(wheelTick)
+			w.advance(now)
+			for t := w.expired.head; t != nil; t = w.expired.head {
+				w.expired.remove(t)
+			}
+		}
+	}
+}
+
+type testLoopTickServer struct {
+	*EventServer
+	numLoops int
+	conns    int
+	ticked   []int32
+	seen     []int32
+}
+
+func (s *testLoopTickServer) TickLoop(loop EventLoopInfo) (delay time.Duration, action Action) {
+	idx := loop.Index()
+	atomic.AddInt32(&s.ticked[idx], 1)
+	n := 0
+	loop.Iterate(func(c Conn) bool {
+		if c.EventLoop().Index() != idx {
+			panic("connection belongs to another event-loop")
+		}
+		n++
+		return true
+	})
+	if n != loop.CountConnections() {
+		panic("Iterate and CountConnections disagree")
+	}
+	atomic.StoreInt32(&s.seen[idx], int32(n))
+	total := 0
+	for i := range s.seen {
+		total += int(atomic.LoadInt32(&s.seen[i]))
+	}
+	if total == s.conns {
+		action = Shutdown
+	}
+	return 10 * time.Millisecond, action
+}
+
+func TestLoopTicker(t *testing.T) {
+	events := &testLoopTickServer{numLoops: 4, conns: 8}
+	events.ticked = make([]int32, events.numLoops)
+	events.seen = make([]int32, events.numLoops)
+	engine, err := Start(events, "tcp://127.0.0.1:0", WithNumEventLoop(events.numLoops),
+		WithTicker(true), WithDisableSignalNotify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < events.conns; i++ {
+		conn, err := net.Dial("tcp", engine.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	select {
+	case <-engine.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("TickLoop did not see all connections")
+	}
+	for i := range events.ticked {
+		if atomic.LoadInt32(&events.ticked[i]) == 0 {
+			t.Fatalf("event-loop:%d did not tick", i)
+		}
+	}
+}
+
+type testWritevServer struct {
+	*EventServer
+	frames int
+	done   chan struct{}
+}
+
+func writevFrame(seq int) [][]byte {
+	header := make([]byte, 8)
+	size := rand.Intn(64 * 1024)
+	binary.BigEndian.PutUint32(header, uint32(seq))
+	binary.BigEndian.PutUint32(header[4:], uint32(size))
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(seq)
+	}
+	// 中间夹一个空的缓冲区
+	return [][]byte{header, nil, payload}
+}
+
+func (s *testWritevServer) OnOpened(c Conn) (out []byte, action Action) {
+	// 总量远大于socket缓冲区，后面的帧会和outboundBuffer中积压的数据一起writev
+	for i := 0; i < s.frames/2; i++ {
+		if err := c.Writev(writevFrame(i)); err != nil {
+			panic(err)
+		}
+	}
+	go func() {
+		for i := s.frames / 2; i < s.frames; i++ {
+			if err := c.AsyncWritev(writevFrame(i)); err != nil {
+				panic(err)
+			}
+		}
+		close(s.done)
+	}()
+	return
+}
+
+func TestWritev(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testWritev(t)
+	})
+	t.Run("poll-ET", func(t *testing.T) {
+		testWritev(t, WithEdgeTriggered(true))
+	})
+	t.Run("io_uring", func(t *testing.T) {
+		testWritev(t, WithIOUring(true))
+	})
+}
+
+func testWritev(t *testing.T, opts ...Option) {
+	events := &testWritevServer{frames: 300, done: make(chan struct{})}
+	engine, err := Start(events, "tcp://127.0.0.1:0", append(opts, WithDisableSignalNotify(true))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 先让服务端的写积压起来
+	time.Sleep(50 * time.Millisecond)
+	<-events.done
+
+	r := bufio.NewReader(conn)
+	header := make([]byte, 8)
+	for seq := 0; seq < events.frames; seq++ {
+		if _, err = io.ReadFull(r, header); err != nil {
+			t.Fatal(err)
+		}
+		if got := int(binary.BigEndian.Uint32(header)); got != seq {
+			t.Fatalf("expected frame %d, got %d", seq, got)
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err = io.ReadFull(r, payload); err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range payload {
+			if b != byte(seq) {
+				t.Fatalf("frame %d is corrupted", seq)
+			}
+		}
+	}
+}
+
+type testSendFileServer struct {
+	*EventServer
+	path string
+	size int64
+}
+
+func (s *testSendFileServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		panic(err)
+	}
+	// 文件和前后写的数据按调用顺序发送，SendFile返回后就可以关闭文件
+	_ = c.Writev([][]byte{[]byte("A")})
+	_ = c.SendFile(f, 100, s.size-100)
+	_ = c.Writev([][]byte{[]byte("B")})
+	_ = c.SendFile(f, 0, 100)
+	_ = f.Close()
+	return []byte("C"), None
+}
+
+func TestSendFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "gnet-sendfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	data := make([]byte, 8*1024*1024)
+	rand.Read(data)
+	if _, err = f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	expected := append([]byte("A"), data[100:]...)
+	expected = append(expected, 'B')
+	expected = append(expected, data[:100]...)
+	expected = append(expected, 'C')
+
+	t.Run("poll", func(t *testing.T) {
+		testSendFile(t, f.Name(), expected)
+	})
+	t.Run("poll-ET", func(t *testing.T) {
+		testSendFile(t, f.Name(), expected, WithEdgeTriggered(true))
+	})
+	t.Run("io_uring", func(t *testing.T) {
+		testSendFile(t, f.Name(), expected, WithIOUring(true))
+	})
+}
+
+func testSendFile(t *testing.T, path string, expected []byte, opts ...Option) {
+	events := &testSendFileServer{path: path, size: int64(len(expected) - 3)}
+	engine, err := Start(events, "tcp://127.0.0.1:0", append(opts, WithDisableSignalNotify(true))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 2; i++ {
+		if _, err = conn.Write([]byte("get")); err != nil {
+			t.Fatal(err)
+		}
+		// 先让服务端的写积压起来
+		time.Sleep(50 * time.Millisecond)
+		got := make([]byte, len(expected))
+		if _, err = io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Fatalf("round %d: received data does not match", i)
+		}
+	}
+}
+
+type testBackpressureServer struct {
+	*EventServer
+	reacted     int32
+	backpressed chan struct{}
+	writable    chan struct{}
+}
+
+func (s *testBackpressureServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	atomic.AddInt32(&s.reacted, 1)
+	return make([]byte, 8*1024*1024), None
+}
+
+func (s *testBackpressureServer) OnBackpressure(c Conn) {
+	s.backpressed <- struct{}{}
+}
+
+func (s *testBackpressureServer) OnWritable(c Conn) {
+	s.writable <- struct{}{}
+}
+
+func TestBackpressure(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testBackpressure(t)
+	})
+	t.Run("poll-ET", func(t *testing.T) {
+		testBackpressure(t, WithEdgeTriggered(true))
+	})
+	t.Run("io_uring", func(t *testing.T) {
+		testBackpressure(t, WithIOUring(true))
+	})
+}
+
+func testBackpressure(t *testing.T, opts ...Option) {
+	events := &testBackpressureServer{backpressed: make(chan struct{}, 4), writable: make(chan struct{}, 4)}
+	opts = append(opts, WithDisableSignalNotify(true), WithOutboundHighWatermark(1024*1024), WithOutboundLowWatermark(64*1024))
+	engine, err := Start(events, "tcp://127.0.0.1:0", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wait := func(ch chan struct{}, name string) {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not called", name)
+		}
+	}
+
+	// 客户端不读，响应积压在outboundBuffer中超过高水位
+	if _, err = conn.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	wait(events.backpressed, "OnBackpressure")
+	// 读已经暂停，这个请求要等恢复之后才处理
+	if _, err = conn.Write([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&events.reacted); n != 1 {
+		t.Fatalf("expected 1 React while reading is paused, got %d", n)
+	}
+
+	buf := make([]byte, 8*1024*1024)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	wait(events.writable, "OnWritable")
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&events.reacted); n != 2 {
+		t.Fatalf("expected 2 Reacts after reading is resumed, got %d", n)
+	}
+}
+
+type testMaxOutboundServer struct {
+	*EventServer
+	conns chan Conn
+}
+
+func (s *testMaxOutboundServer) OnOpened(c Conn) (out []byte, action Action) {
+	s.conns <- c
+	return
+}
+
+func TestMaxOutboundBuffer(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testMaxOutboundBuffer(t)
+	})
+	t.Run("io_uring", func(t *testing.T) {
+		testMaxOutboundBuffer(t, WithIOUring(true))
+	})
+}
+
+func testMaxOutboundBuffer(t *testing.T, opts ...Option) {
+	events := &testMaxOutboundServer{conns: make(chan Conn, 1)}
+	opts = append(opts, WithDisableSignalNotify(true), WithMaxOutboundBuffer(1024*1024))
+	engine, err := Start(events, "tcp://127.0.0.1:0", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := <-events.conns
+
+	if err = c.AsyncWrite(make([]byte, 1024*1024+1)); err != ErrOutboundBufferFull {
+		t.Fatalf("expected ErrOutboundBufferFull for a write larger than the limit, got %v", err)
+	}
+	// 客户端不读，socket缓冲区满了之后数据积压在outboundBuffer中
+	var written int
+	for i := 0; ; i++ {
+		if i == 1000 {
+			t.Fatal("AsyncWrite never returned ErrOutboundBufferFull")
+		}
+		err = c.AsyncWritev([][]byte{make([]byte, 256*1024)})
+		if err == ErrOutboundBufferFull {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		written += 256 * 1024
+		time.Sleep(time.Millisecond)
+	}
+	// 之前接受的数据都会完整发送
+	if _, err = io.ReadFull(conn, make([]byte, written)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testCloseFlushServer struct {
+	*EventServer
+}
+
+func (s *testCloseFlushServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	// 第一次写还在发送时第二次写进入排队，然后马上关闭连接
+	_ = c.Writev([][]byte{bytes.Repeat([]byte{'a'}, 16*1024)})
+	return bytes.Repeat([]byte{'b'}, 16*1024), Close
+}
+
+// 关闭连接之前已经写成功的数据都要发送给对端
+func TestCloseFlush(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testCloseFlush(t)
+	})
+	t.Run("io_uring", func(t *testing.T) {
+		testCloseFlush(t, WithIOUring(true))
+	})
+}
+
+func testCloseFlush(t *testing.T, opts ...Option) {
+	engine, err := Start(&testCloseFlushServer{}, "tcp://127.0.0.1:0", append(opts, WithDisableSignalNotify(true))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("close")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(bytes.Repeat([]byte{'a'}, 16*1024), bytes.Repeat([]byte{'b'}, 16*1024)...)
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("expected %d bytes before EOF, got %d", len(expected), len(got))
+	}
+}
+
+type testStopFlushServer struct {
+	*EventServer
+	closed chan struct{}
+}
+
+func (s *testStopFlushServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	// 客户端不读，关闭时发送队列中还有数据
+	return make([]byte, 8*1024*1024), Close
+}
+
+func (s *testStopFlushServer) OnClosed(c Conn, err error) (action Action) {
+	close(s.closed)
+	return
+}
+
+// 连接已经关闭、io_uring发送队列中的数据还没发完时，优雅关闭要等它们发完
+func TestStopFlushClosed(t *testing.T) {
+	t.Run("io_uring", func(t *testing.T) {
+		events := &testStopFlushServer{closed: make(chan struct{})}
+		// 缓冲区很小，内核放不下发送队列中的数据
+		engine, err := Start(events, "tcp://127.0.0.1:0", WithDisableSignalNotify(true), WithIOUring(true),
+			WithSocketSendBuffer(4096))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialer := net.Dialer{Control: func(network, address string, rc syscall.RawConn) error {
+			return rc.Control(func(fd uintptr) {
+				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4096)
+			})
+		}}
+		conn, err := dialer.Dial("tcp", engine.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err = conn.Write([]byte("close")); err != nil {
+			t.Fatal(err)
+		}
+		<-events.closed
+
+		stopped := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			stopped <- engine.Stop(ctx)
+		}()
+		select {
+		case err = <-stopped:
+			t.Fatalf("expected Stop to wait for the queued data, got %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = io.Copy(ioutil.Discard, conn); err != nil {
+			t.Fatal(err)
+		}
+		if err = <-stopped; err != nil {
+			t.Fatalf("expected graceful stop, got %v", err)
+		}
+	})
+}
+
+type testPauseReadServer struct {
+	*EventServer
+	busy     int32
+	violated int32
+}
+
+func (s *testPauseReadServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	// 读暂停期间不应该再收到帧
+	if !atomic.CompareAndSwapInt32(&s.busy, 0, 1) {
+		atomic.StoreInt32(&s.violated, 1)
+	}
+	data := append([]byte(nil), frame...)
+	if err := c.PauseRead(); err != nil {
+		panic(err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = c.AsyncWrite(data)
+		atomic.StoreInt32(&s.busy, 0)
+		if err := c.ResumeRead(); err != nil {
+			panic(err)
+		}
+	}()
+	return
+}
+
+func TestPauseRead(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testPauseRead(t)
+	})
+	t.Run("poll-ET", func(t *testing.T) {
+		testPauseRead(t, WithEdgeTriggered(true))
+	})
+	t.Run("io_uring", func(t *testing.T) {
+		testPauseRead(t, WithIOUring(true))
+	})
+}
+
+func testPauseRead(t *testing.T, opts ...Option) {
+	events := new(testPauseReadServer)
+	opts = append(opts, WithDisableSignalNotify(true), WithCodec(new(LineBasedFrameCodec)))
+	engine, err := Start(events, "tcp://127.0.0.1:0", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 一次发出所有请求，服务端读到的同一块数据中包含多个帧
+	var req bytes.Buffer
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&req, "%d\n", i)
+	}
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for i := 0; i < 10; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("%d\n", i); line != expected {
+			t.Fatalf("expected %q, got %q", expected, line)
+		}
+	}
+	if atomic.LoadInt32(&events.violated) != 0 {
+		t.Fatal("React was called while reading is paused")
+	}
+}
+
+type testAsyncReactServer struct {
+	*EventServer
+	running    int32
+	concurrent int32
+}
+
+func (s *testAsyncReactServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	n := atomic.AddInt32(&s.running, 1)
+	defer atomic.AddInt32(&s.running, -1)
+	for {
+		max := atomic.LoadInt32(&s.concurrent)
+		if n <= max || atomic.CompareAndSwapInt32(&s.concurrent, max, n) {
+			break
+		}
+	}
+	// 先提交的帧不一定先执行完，结果仍然要按顺序写出
+	time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+	return frame, None
+}
+
+func TestAsyncReact(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testAsyncReact(t, 1)
+	})
+	t.Run("poll-4-reacts", func(t *testing.T) {
+		testAsyncReact(t, 4)
+	})
+	t.Run("poll-ET-4-reacts", func(t *testing.T) {
+		testAsyncReact(t, 4, WithEdgeTriggered(true))
+	})
+	t.Run("io_uring-4-reacts", func(t *testing.T) {
+		testAsyncReact(t, 4, WithIOUring(true))
+	})
+}
+
+func testAsyncReact(t *testing.T, maxConnReacts int, opts ...Option) {
+	events := new(testAsyncReactServer)
+	opts = append(opts, WithDisableSignalNotify(true), WithCodec(new(LineBasedFrameCodec)),
+		WithAsyncReact(true), WithMaxConnReacts(maxConnReacts))
+	engine, err := Start(events, "tcp://127.0.0.1:0", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var req bytes.Buffer
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&req, "%d\n", i)
+	}
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for i := 0; i < 200; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("%d\n", i); line != expected {
+			t.Fatalf("expected %q, got %q", expected, line)
+		}
+	}
+	if n := atomic.LoadInt32(&events.concurrent); n > int32(maxConnReacts) {
+		t.Fatalf("expected at most %d concurrent Reacts, got %d", maxConnReacts, n)
+	}
+}
+
+type testStopReactServer struct {
+	*EventServer
+	started  chan struct{}
+	block    chan struct{}
+	returned int32
+	shutdown chan bool
+}
+
+func (s *testStopReactServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	close(s.started)
+	<-s.block
+	atomic.StoreInt32(&s.returned, 1)
+	return frame, None
+}
+
+func (s *testStopReactServer) OnShutdown(svr Server) {
+	s.shutdown <- atomic.LoadInt32(&s.returned) == 1
+}
+
+// 强制关闭时还在执行的React结束后才关闭poller，React的结果不会Trigger到已经关闭的poller上
+func TestStopWaitsForReact(t *testing.T) {
+	events := &testStopReactServer{started: make(chan struct{}), block: make(chan struct{}), shutdown: make(chan bool, 1)}
+	engine, err := Start(events, "tcp://127.0.0.1:0", WithDisableSignalNotify(true),
+		WithCodec(new(LineBasedFrameCodec)), WithAsyncReact(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("block\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-events.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- engine.Stop(ctx)
+	}()
+	select {
+	case err = <-stopped:
+		t.Fatalf("expected Stop to wait for React, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(events.block)
+	if err = <-stopped; err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if !<-events.shutdown {
+		t.Fatal("OnShutdown was called before React returned")
+	}
+}
+
+type testReactOverloadServer struct {
+	*EventServer
+	block  chan struct{}
+	closed chan error
+}
+
+func (s *testReactOverloadServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	if string(frame) == "block" {
+		<-s.block
+	}
+	return frame, None
+}
+
+func (s *testReactOverloadServer) OnClosed(c Conn, err error) (action Action) {
+	s.closed <- err
+	return
+}
+
+func TestReactOverloadPolicy(t *testing.T) {
+	t.Run("close", func(t *testing.T) {
+		testReactOverloadPolicy(t, CloseConnOnOverload)
+	})
+	t.Run("backpressure", func(t *testing.T) {
+		testReactOverloadPolicy(t, BackpressureOnOverload)
+	})
+}
+
+func testReactOverloadPolicy(t *testing.T, policy ReactOverloadPolicy) {
+	events := &testReactOverloadServer{block: make(chan struct{}), closed: make(chan error, 2)}
+	opts := []Option{WithDisableSignalNotify(true), WithCodec(new(LineBasedFrameCodec)),
+		WithAsyncReact(true), WithReactPoolSize(1), WithReactOverloadPolicy(policy)}
+	engine, err := Start(events, "tcp://127.0.0.1:0", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	// 第一个连接占住pool中唯一的worker
+	blocker, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+	if _, err = blocker.Write([]byte("block\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	switch policy {
+	case CloseConnOnOverload:
+		select {
+		case err = <-events.closed:
+			if err != goroutine.ErrPoolOverload {
+				t.Fatalf("expected ErrPoolOverload, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection was not closed")
+		}
+		close(events.block)
+	case BackpressureOnOverload:
+		time.Sleep(50 * time.Millisecond)
+		close(events.block)
+		// pool空出来之后重新提交
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "hello\n" {
+			t.Fatalf("expected %q, got %q", "hello\n", line)
+		}
+	}
+	line, err := bufio.NewReader(blocker).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "block\n" {
+		t.Fatalf("expected %q, got %q", "block\n", line)
+	}
+}
+
+type testEchoServer struct {
+	*EventServer
+}
+
+func (s *testEchoServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	return frame, None
+}
+
+type testClientHandler struct {
+	*EventServer
+	opened   chan Conn
+	received chan []byte
+	closed   chan error
+}
+
+func newTestClientHandler() *testClientHandler {
+	return &testClientHandler{opened: make(chan Conn, 4), received: make(chan []byte, 16), closed: make(chan error, 4)}
+}
+
+func (h *testClientHandler) OnOpened(c Conn) (out []byte, action Action) {
+	h.opened <- c
+	return
+}
+
+func (h *testClientHandler) React(frame []byte, c Conn) (out []byte, action Action) {
+	h.received <- append([]byte(nil), frame...)
+	return
+}
+
+func (h *testClientHandler) OnClosed(c Conn, err error) (action Action) {
+	h.closed <- err
+	return
+}
+
+// 读到n个字节或者超时
+func (h *testClientHandler) receive(t *testing.T, n int) []byte {
+	var got []byte
+	for len(got) < n {
+		select {
+		case b := <-h.received:
+			got = append(got, b...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d bytes, got %d", n, len(got))
+		}
+	}
+	return got
+}
+
+func TestClient(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testClient(t)
+	})
+	t.Run("poll-ET", func(t *testing.T) {
+		testClient(t, WithEdgeTriggered(true))
+	})
+	t.Run("io_uring", func(t *testing.T) {
+		testClient(t, WithIOUring(true))
+	})
+}
+
+func testClient(t *testing.T, opts ...Option) {
+	engine, err := Start(new(testEchoServer), "tcp://127.0.0.1:0", WithDisableSignalNotify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	h := newTestClientHandler()
+	cli, err := NewClient(h, append(opts, WithDisableSignalNotify(true))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cli.Stop(context.Background())
+	}()
+
+	c, err := cli.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 连接建立之前写的数据会在建立后发送
+	if err = c.AsyncWrite([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case oc := <-h.opened:
+		if oc.RemoteAddr().String() != engine.Addr().String() {
+			t.Fatalf("expected remote address %s, got %s", engine.Addr(), oc.RemoteAddr())
+		}
+		if oc.LocalAddr() == nil {
+			t.Fatal("local address is not set")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnOpened was not called")
+	}
+	if got := h.receive(t, 5); string(got) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", got)
+	}
+	if err = c.AsyncWrite([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.receive(t, 5); string(got) != "world" {
+		t.Fatalf("expected %q, got %q", "world", got)
+	}
+
+	// 连接失败时OnClosed收到connect的错误
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	if _, err = cli.Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-h.closed:
+		if !errors.Is(err, unix.ECONNREFUSED) {
+			t.Fatalf("expected ECONNREFUSED, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClosed was not called")
+	}
+}
+
+type testRegisterServer struct {
+	*testClientHandler
+	// Start返回之后才能设置，React在eventloop goroutine中读取
+	engine   atomic.Value
+	upstream string
+	loops    chan [2]int
+}
+
+// 收到请求后在同一个eventloop上接管到上游的连接
+func (s *testRegisterServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	if c.RemoteAddr().String() != s.upstream {
+		nc, err := net.Dial("tcp", s.upstream)
+		if err != nil {
+			panic(err)
+		}
+		uc, err := s.engine.Load().(*Engine).Register(nc, c.EventLoop())
+		if err != nil {
+			panic(err)
+		}
+		_ = uc.AsyncWrite(frame)
+		s.loops <- [2]int{c.EventLoop().Index(), uc.EventLoop().Index()}
+		return
+	}
+	return s.testClientHandler.React(frame, c)
+}
+
+func TestRegister(t *testing.T) {
+	upstream, err := Start(new(testEchoServer), "tcp://127.0.0.1:0", WithDisableSignalNotify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = upstream.Stop(context.Background())
+	}()
+
+	events := &testRegisterServer{testClientHandler: newTestClientHandler(), upstream: upstream.Addr().String(),
+		loops: make(chan [2]int, 1)}
+	engine, err := Start(events, "tcp://127.0.0.1:0", WithDisableSignalNotify(true), WithNumEventLoop(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events.engine.Store(engine)
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if loops := <-events.loops; loops[0] != loops[1] {
+		t.Fatalf("expected the upstream connection on event-loop:%d, got %d", loops[0], loops[1])
+	}
+	if got := events.receive(t, 4); string(got) != "ping" {
+		t.Fatalf("expected %q, got %q", "ping", got)
+	}
+
+	// 其他engine的eventloop
+	other, err := Start(new(testEchoServer), "tcp://127.0.0.1:0", WithDisableSignalNotify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = other.Stop(context.Background())
+	}()
+	nc, err := net.Dial("tcp", upstream.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	if _, err = other.Register(nc, (<-events.opened).EventLoop()); err != ErrInvalidEventLoop {
+		t.Fatalf("expected ErrInvalidEventLoop, got %v", err)
+	}
+}
+
+// accept、Dial、Register会在不同的goroutine中同时选择eventloop
+func TestLoadBalancerConcurrentNext(t *testing.T) {
+	balancers := map[string]loadBalancer{
+		"round-robin":       new(roundRobinEventLoopSet),
+		"least-connections": new(leastConnectionsEventLoopSet),
+		"source-addr-hash":  new(sourceAddrHashEventLoopSet),
+	}
+	for name, lb := range balancers {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				lb.register(&eventloop{})
+			}
+			var (
+				wg     sync.WaitGroup
+				mu     sync.Mutex
+				counts = make(map[*eventloop]int)
+			)
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < 999; i++ {
+						el := lb.next(g*999 + i)
+						lb.calibrate(el, 1)
+						mu.Lock()
+						counts[el]++
+						mu.Unlock()
+					}
+				}(g)
+			}
+			wg.Wait()
+			if name == "round-robin" {
+				for _, n := range counts {
+					if n != 8*999/3 {
+						t.Fatalf("unbalanced round-robin: %v", counts)
+					}
+				}
+			}
+		})
+	}
+}
+
+// 生成自签名证书，服务端使用证书，客户端信任它
+func testTLSConfigs(t *testing.T, serverName string) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: serverName},
+		DNSNames:              []string{serverName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	client = &tls.Config{RootCAs: roots, ServerName: serverName, NextProtos: []string{"h2"}}
+	return
+}
+
+type testTLSServer struct {
+	*testEchoServer
+	states chan *tls.ConnectionState
+}
+
+func (s *testTLSServer) OnOpened(c Conn) (out []byte, action Action) {
+	s.states <- c.TLSConnectionState()
+	return
+}
+
+func TestTLS(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testTLS(t)
+	})
+	t.Run("poll-ET", func(t *testing.T) {
+		testTLS(t, WithEdgeTriggered(true))
+	})
+	t.Run("io_uring", func(t *testing.T) {
+		testTLS(t, WithIOUring(true))
+	})
+}
+
+type testTLSCloseServer struct {
+	*EventServer
+}
+
+func (s *testTLSCloseServer) OnOpened(c Conn) (out []byte, action Action) {
+	return []byte("bye"), Close
+}
+
+// 记录底层连接是否读到了EOF
+type testEOFConn struct {
+	net.Conn
+	eof bool
+}
+
+func (c *testEOFConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == io.EOF {
+		c.eof = true
+	}
+	return n, err
+}
+
+// 服务端关闭TLS连接时先发送close_notify，客户端不需要读到TCP的EOF就能结束
+func TestTLSCloseNotify(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testTLSCloseNotify(t)
+	})
+	t.Run("io_uring", func(t *testing.T) {
+		testTLSCloseNotify(t, WithIOUring(true))
+	})
+}
+
+func testTLSCloseNotify(t *testing.T, opts ...Option) {
+	serverConfig, clientConfig := testTLSConfigs(t, "example.com")
+	engine, err := Start(&testTLSCloseServer{}, "tcp://127.0.0.1:0",
+		append(opts, WithDisableSignalNotify(true), WithTLSConfig(serverConfig))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	nc, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	_ = nc.SetDeadline(time.Now().Add(5 * time.Second))
+	raw := &testEOFConn{Conn: nc}
+	conn := tls.Client(raw, clientConfig)
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "bye" {
+		t.Fatalf("expected %q, got %q", "bye", got)
+	}
+	if raw.eof {
+		t.Fatal("connection was closed without close_notify")
+	}
+}
+
+type testHandshakeServer struct {
+	*testEchoServer
+	opened chan struct{}
+	closed chan error
+}
+
+func (s *testHandshakeServer) OnOpened(c Conn) (out []byte, action Action) {
+	s.opened <- struct{}{}
+	return
+}
+
+func (s *testHandshakeServer) OnClosed(c Conn, err error) (action Action) {
+	s.closed <- err
+	return
+}
+
+// 每次只写几个字节，握手要多次交还给eventloop等待后续的密文
+type testSlowConn struct {
+	net.Conn
+}
+
+func (c *testSlowConn) Write(b []byte) (int, error) {
+	for i := 0; i < len(b); i += 7 {
+		end := i + 7
+		if end > len(b) {
+			end = len(b)
+		}
+		if _, err := c.Conn.Write(b[i:end]); err != nil {
+			return i, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return len(b), nil
+}
+
+func TestTLSHandshake(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t, "example.com")
+	events := &testHandshakeServer{
+		testEchoServer: new(testEchoServer), opened: make(chan struct{}, 1), closed: make(chan error, 1),
+	}
+	engine, err := Start(events, "tcp://127.0.0.1:0", WithDisableSignalNotify(true), WithTLSConfig(serverConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	t.Run("fragmented", func(t *testing.T) {
+		nc, err := net.Dial("tcp", engine.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = nc.SetDeadline(time.Now().Add(5 * time.Second))
+		conn := tls.Client(&testSlowConn{nc}, clientConfig)
+		if _, err = conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 5)
+		if _, err = io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "hello" {
+			t.Fatalf("expected %q, got %q", "hello", got)
+		}
+		<-events.opened
+		_ = conn.Close()
+		<-events.closed
+	})
+	// 握手期间对端关闭，连接以握手的错误关闭，不会调用OnOpened
+	t.Run("eof", func(t *testing.T) {
+		nc, err := net.Dial("tcp", engine.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// ClientHello记录的开头
+		if _, err = nc.Write([]byte{0x16, 0x03, 0x01, 0x01, 0x00, 0x01}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		_ = nc.Close()
+		select {
+		case err = <-events.closed:
+			if err == nil {
+				t.Fatal("expected a handshake error")
+			}
+		case <-events.opened:
+			t.Fatal("OnOpened was called without a handshake")
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnClosed was not called")
+		}
+	})
+}
+
+// 握手超时的连接没有调用过OnOpened，只调用OnClosed，连接数也要减回去
+func TestTLSHandshakeTimeout(t *testing.T) {
+	serverConfig, _ := testTLSConfigs(t, "example.com")
+	events := &testHandshakeServer{
+		testEchoServer: new(testEchoServer), opened: make(chan struct{}, 1), closed: make(chan error, 1),
+	}
+	engine, err := Start(events, "tcp://127.0.0.1:0", WithDisableSignalNotify(true), WithTLSConfig(serverConfig),
+		WithReadTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	nc, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	select {
+	case err = <-events.closed:
+		if err != ErrReadTimeout {
+			t.Fatalf("expected %v, got %v", ErrReadTimeout, err)
+		}
+	case <-events.opened:
+		t.Fatal("OnOpened was called without a handshake")
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClosed was not called")
+	}
+	if n := engine.CountConnections(); n != 0 {
+		t.Fatalf("expected 0 connections, got %d", n)
+	}
+}
+
+func testTLS(t *testing.T, opts ...Option) {
+	serverConfig, clientConfig := testTLSConfigs(t, "example.com")
+	events := &testTLSServer{testEchoServer: new(testEchoServer), states: make(chan *tls.ConnectionState, 2)}
+	engine, err := Start(events, "tcp://127.0.0.1:0",
+		append(opts, WithDisableSignalNotify(true), WithTLSConfig(serverConfig))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := tls.Dial("tcp", engine.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case state := <-events.states:
+		if state == nil {
+			t.Fatal("TLS connection state is nil")
+		}
+		if state.NegotiatedProtocol != "h2" {
+			t.Fatalf("expected ALPN protocol %q, got %q", "h2", state.NegotiatedProtocol)
+		}
+		if state.ServerName != "example.com" {
+			t.Fatalf("expected SNI %q, got %q", "example.com", state.ServerName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnOpened was not called")
+	}
+	if conn.ConnectionState().NegotiatedProtocol != "h2" {
+		t.Fatalf("expected ALPN protocol %q on the client, got %q", "h2", conn.ConnectionState().NegotiatedProtocol)
+	}
+
+	// 跨越多条TLS记录、多次读的数据
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	go func() {
+		_, _ = conn.Write(data)
+	}()
+	got := make([]byte, len(data))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("mismatched echo data")
+	}
+
+	// gnet的Client作为TLS客户端，握手完成之前写的数据会在握手后加密发送
+	h := newTestClientHandler()
+	clientConfig = clientConfig.Clone()
+	clientConfig.ServerName = ""
+	cli, err := NewClient(h, append(opts, WithDisableSignalNotify(true), WithTLSConfig(clientConfig))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cli.Stop(context.Background())
+	}()
+	// ServerName取自地址
+	c, err := cli.Dial("tcp", "localhost:"+strconv.Itoa(engine.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.AsyncWrite([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-h.closed:
+		// 证书只对example.com有效
+		var certErr x509.HostnameError
+		if !errors.As(err, &certErr) {
+			t.Fatalf("expected x509.HostnameError, got %v", err)
+		}
+	case <-h.opened:
+		t.Fatal("handshake with a mismatched server name succeeded")
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClosed was not called")
+	}
+
+	clientConfig.ServerName = "example.com"
+	if c, err = cli.Dial("tcp", engine.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.AsyncWrite([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case oc := <-h.opened:
+		if state := oc.TLSConnectionState(); state == nil || state.NegotiatedProtocol != "h2" {
+			t.Fatalf("unexpected TLS connection state %+v", state)
+		}
+	case err = <-h.closed:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnOpened was not called")
+	}
+	if got := h.receive(t, 5); string(got) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", got)
+	}
+	if err = c.AsyncWrite([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.receive(t, 5); string(got) != "world" {
+		t.Fatalf("expected %q, got %q", "world", got)
+	}
+}
+
+type testListenersServer struct {
+	*EventServer
+	local chan net.Addr
+}
+
+func (s *testListenersServer) OnOpened(c Conn) (out []byte, action Action) {
+	s.local <- c.LocalAddr()
+	return
+}
+
+func (s *testListenersServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	if c.RemoteAddr().Network() == "udp" {
+		s.local <- c.LocalAddr()
+	}
+	return append([]byte("<"), frame...), None
+}
+
+func TestListeners(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testListeners(t, false)
+	})
+	t.Run("poll-ET", func(t *testing.T) {
+		testListeners(t, false, WithEdgeTriggered(true))
+	})
+	// 有UDP的listener时不使用main reactor
+	t.Run("udp", func(t *testing.T) {
+		testListeners(t, true)
+	})
+}
+
+func testListeners(t *testing.T, udp bool, opts ...Option) {
+	sock := filepath.Join(t.TempDir(), "gnet.sock")
+	listeners := []ListenerConfig{
+		{Addr: "tcp6://[::1]:0"},
+		{Addr: "unix://" + sock, Codec: NewDelimiterBasedFrameCodec('|')},
+	}
+	if udp {
+		listeners = append(listeners, ListenerConfig{Addr: "udp://127.0.0.1:0"})
+	}
+	events := &testListenersServer{local: make(chan net.Addr, 1)}
+	engine, err := Start(events, "tcp://127.0.0.1:0",
+		append(opts, WithDisableSignalNotify(true), WithNumEventLoop(2), WithListeners(listeners...))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+	addrs := engine.Addrs()
+	if len(addrs) != len(listeners)+1 || addrs[0] != engine.Addr() {
+		t.Fatalf("unexpected listener addresses %v", addrs)
+	}
+
+	// 只有unix的listener使用DelimiterBasedFrameCodec
+	expected := []string{"<a|b|", "<a|b|", "<a|<b|", "<a|b|"}
+	for i, addr := range addrs {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write([]byte("a|b|")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case local := <-events.local:
+			if local.String() != addr.String() {
+				t.Fatalf("expected local address %s, got %s", addr, local)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no connection on %s", addr)
+		}
+		got := make([]byte, len(expected[i]))
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != expected[i] {
+			t.Fatalf("expected %q from %s, got %q", expected[i], addr, got)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		// 其他系统上127.0.0.2默认不是本机地址
+		t.Skip("127.0.0.0/8 is only routed to loopback on linux")
+	}
+	t.Run("tcp", func(t *testing.T) {
+		testLocalAddr(t, "tcp", "tcp://0.0.0.0:0", "127.0.0.2")
+	})
+	t.Run("udp", func(t *testing.T) {
+		testLocalAddr(t, "udp", "udp://0.0.0.0:0", "127.0.0.2")
+	})
+	t.Run("udp6", func(t *testing.T) {
+		testLocalAddr(t, "udp", "udp6://[::]:0", "::1")
+	})
+}
+
+// 监听通配地址时，LocalAddr是连接、数据报实际到达的地址，UDP的回复也从这个地址发出
+func testLocalAddr(t *testing.T, network, addr, ip string) {
+	events := &testListenersServer{local: make(chan net.Addr, 1)}
+	engine, err := Start(events, addr, WithDisableSignalNotify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+	var port int
+	switch a := engine.Addr().(type) {
+	case *net.TCPAddr:
+		port = a.Port
+	case *net.UDPAddr:
+		port = a.Port
+	}
+	target := net.JoinHostPort(ip, strconv.Itoa(port))
+
+	// 连接的UDP socket只接收来自target的数据报，回复的源地址不对时读不到
+	conn, err := net.Dial(network, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case local := <-events.local:
+		if local.String() != target {
+			t.Fatalf("expected local address %s, got %s", target, local)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection or datagram")
+	}
+	got := make([]byte, 5)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "<ping" {
+		t.Fatalf("expected %q, got %q", "<ping", got)
+	}
+}
+
+// 大于0的SO_LINGER会让close阻塞event-loop，Start、NewClient直接返回错误
+func TestSocketLingerRejected(t *testing.T) {
+	if _, err := Start(new(EventServer), "tcp://127.0.0.1:0", WithDisableSignalNotify(true),
+		WithSocketLinger(3)); !errors.Is(err, ErrUnsupportedLinger) {
+		t.Fatalf("expected %v, got %v", ErrUnsupportedLinger, err)
+	}
+	if _, err := Start(new(EventServer), "tcp://127.0.0.1:0", WithDisableSignalNotify(true),
+		WithListeners(ListenerConfig{Addr: "tcp://127.0.0.1:0", SocketOptions: &SocketOptions{SocketLinger: 3}}),
+	); !errors.Is(err, ErrUnsupportedLinger) {
+		t.Fatalf("expected %v from the listener options, got %v", ErrUnsupportedLinger, err)
+	}
+	if _, err := NewClient(new(EventServer), WithDisableSignalNotify(true),
+		WithSocketLinger(3)); !errors.Is(err, ErrUnsupportedLinger) {
+		t.Fatalf("expected %v from NewClient, got %v", ErrUnsupportedLinger, err)
+	}
+}
+
+func TestNativeListener(t *testing.T) {
+	// tcp监听通配地址时和net.Listen一样是双栈的IPv6 socket
+	t.Run("dual-stack", func(t *testing.T) {
+		engine := testNativeListener(t, "tcp://:0")
+		if v, err := unix.GetsockoptInt(engine.svr.lns[0].fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY); err != nil {
+			t.Skip("IPv6 is not supported")
+		} else if v != 0 {
+			t.Fatal("IPV6_V6ONLY is set on the dual-stack listener")
+		}
+		port := strconv.Itoa(engine.Addr().(*net.TCPAddr).Port)
+		testNativeListenerEcho(t, "tcp", net.JoinHostPort("127.0.0.1", port))
+		testNativeListenerEcho(t, "tcp", net.JoinHostPort("::1", port))
+	})
+	t.Run("abstract", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("abstract unix sockets are only supported on linux")
+		}
+		name := "@gnet-test-" + strconv.Itoa(os.Getpid())
+		engine := testNativeListener(t, "unix://"+name)
+		if addr := engine.Addr().String(); addr != name {
+			t.Fatalf("expected listener address %s, got %s", name, addr)
+		}
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("unexpected file %s for the abstract unix socket", name)
+		}
+		testNativeListenerEcho(t, "unix", name)
+	})
+	// SO_REUSEPORT在bind之前设置，两个server可以监听同一个端口
+	t.Run("reuseport", func(t *testing.T) {
+		engine := testNativeListener(t, "tcp://127.0.0.1:0", WithReusePort(true))
+		if v, err := unix.GetsockoptInt(engine.svr.lns[0].fd, unix.SOL_SOCKET, unix.SO_REUSEPORT); err != nil || v == 0 {
+			t.Fatalf("SO_REUSEPORT is not set: %v", err)
+		}
+		addr := engine.Addr().String()
+		other := testNativeListener(t, "tcp://"+addr, WithReusePort(true))
+		if other.Addr().String() != addr {
+			t.Fatalf("expected listener address %s, got %s", addr, other.Addr())
+		}
+		if _, err := Start(&testListenersServer{}, "tcp://"+addr, WithDisableSignalNotify(true)); err == nil {
+			t.Fatal("expected bind error without SO_REUSEPORT")
+		}
+	})
+}
+
+func testNativeListener(t *testing.T, addr string, opts ...Option) *Engine {
+	// 每个连接的OnOpened都会发送LocalAddr，这里不读
+	events := &testListenersServer{local: make(chan net.Addr, 16)}
+	engine, err := Start(events, addr, append(opts, WithDisableSignalNotify(true))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = engine.Stop(context.Background())
+	})
+	return engine
+}
+
+func testNativeListenerEcho(t *testing.T, network, addr string) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "<ping" {
+		t.Fatalf("expected %q from %s, got %q", "<ping", addr, got)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	t.Run("line", func(t *testing.T) {
+		testFrameTooLarge(t, &LineBasedFrameCodec{MaxFrameLength: 8}, []byte("12345678\n"), []byte("123456789"),
+			FrameTooLargeError{Length: 9, Limit: 8})
+	})
+	// 分隔符已经到达，帧仍然太长
+	t.Run("delimiter", func(t *testing.T) {
+		codec := NewDelimiterBasedFrameCodec('|')
+		codec.MaxFrameLength = 4
+		testFrameTooLarge(t, codec, []byte("abcd|"), []byte("abcde|"), FrameTooLargeError{Length: 5, Limit: 4})
+	})
+	// 只收到长度字段就关闭，不等消息体
+	t.Run("length-field", func(t *testing.T) {
+		codec := NewLengthFieldBasedFrameCodec(
+			EncoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 4},
+			DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 4, InitialBytesToStrip: 4, MaxFrameLength: 16})
+		// 32位平台上超出int范围的长度报告为maxInt
+		length := maxInt
+		if n := uint64(4 + 1<<31); n < uint64(maxInt) {
+			length = int(n)
+		}
+		testFrameTooLarge(t, codec, []byte{0, 0, 0, 12, 'h', 'e', 'l', 'l', 'o', ' ', 'w', 'o', 'r', 'l', 'd', '!'},
+			[]byte{0x80, 0, 0, 0}, FrameTooLargeError{Length: length, Limit: 16})
+	})
+	// varint前缀声明的长度超过限制
+	t.Run("varint", func(t *testing.T) {
+		testFrameTooLarge(t, &VarintLengthFrameCodec{MaxFrameLength: 200}, []byte("\x05hello"), []byte{0xc9, 0x01},
+			FrameTooLargeError{Length: 201, Limit: 200})
+	})
+	t.Run("inbound", func(t *testing.T) {
+		testFrameTooLarge(t, NewFixedLengthFrameCodec(1024), nil, make([]byte, 200),
+			FrameTooLargeError{Length: 200, Limit: 100, Inbound: true}, WithMaxInboundBuffer(100))
+	})
+}
+
+// 先发送不超过限制的ok，回显后再发送超过限制的bad，OnClosed应该收到expected
+func testFrameTooLarge(t *testing.T, codec ICodec, ok, bad []byte, expected FrameTooLargeError, opts ...Option) {
+	events := &testTimeoutServer{closed: make(chan error, 1)}
+	engine, err := Start(events, "tcp://127.0.0.1:0", append(opts, WithDisableSignalNotify(true), WithCodec(codec))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if len(ok) > 0 {
+		if _, err = conn.Write(ok); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(ok))
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, ok) {
+			t.Fatalf("expected %q, got %q", ok, got)
+		}
+	}
+	if _, err = conn.Write(bad); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-events.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+	var tooLarge *FrameTooLargeError
+	if !errors.As(err, &tooLarge) || *tooLarge != expected {
+		t.Fatalf("expected %v, got %v", &expected, err)
+	}
+}
+
+type testErrorServer struct {
+	*EventServer
+	closed chan error
+}
+
+func (s *testErrorServer) OnClosed(c Conn, err error) (action Action) {
+	s.closed <- err
+	return
+}
+
+// half的回复长度不对，FixedLengthFrameCodec的Encode会出错
+func (s *testErrorServer) React(frame []byte, c Conn) (out []byte, action Action) {
+	if string(frame) == "half" {
+		return frame[:2], None
+	}
+	return frame, None
+}
+
+type testErrorHandler struct {
+	testErrorServer
+	errs chan error
+}
+
+func (s *testErrorHandler) OnError(c Conn, err error) (action Action) {
+	s.errs <- err
+	return None
+}
+
+func TestCodecError(t *testing.T) {
+	if !errors.Is(ErrCRLFNotFound, ErrIncompleteFrame) || errors.Is(ErrUnsupportedLength, ErrIncompleteFrame) {
+		t.Fatal("unexpected classification of codec errors")
+	}
+	if !errors.Is(&FrameTooLargeError{Length: 2, Limit: 1}, ErrFrameTooLarge) {
+		t.Fatal("FrameTooLargeError does not match ErrFrameTooLarge")
+	}
+	// 没有ErrorHandler时关闭连接
+	t.Run("decode", func(t *testing.T) {
+		codec := NewLengthFieldBasedFrameCodec(EncoderConfig{}, DecoderConfig{LengthFieldLength: 5})
+		testCodecError(t, &testErrorServer{}, codec, nil, "hello", ErrUnsupportedLength)
+	})
+	t.Run("encode", func(t *testing.T) {
+		testCodecError(t, &testErrorServer{}, NewFixedLengthFrameCodec(4), nil, "half", ErrInvalidFixedLength)
+	})
+	// OnError返回None时丢弃出错的数据，连接继续使用
+	t.Run("decode-none", func(t *testing.T) {
+		testCodecError(t, &testErrorHandler{errs: make(chan error, 1)}, &LineBasedFrameCodec{MaxFrameLength: 4},
+			[]byte("ab\n"), "abcdef", ErrFrameTooLarge)
+	})
+	// 和数据无关的错误，OnError返回None后不能一直重复解码，同一个eventloop上的其他连接要照常处理
+	t.Run("decode-none-config", func(t *testing.T) {
+		testCodecErrorNoSpin(t)
+	})
+	t.Run("encode-none", func(t *testing.T) {
+		testCodecError(t, &testErrorHandler{errs: make(chan error, 1)}, NewFixedLengthFrameCodec(4),
+			[]byte("abcd"), "half", ErrInvalidFixedLength)
+	})
+	t.Run("encode-none-async", func(t *testing.T) {
+		testCodecError(t, &testErrorHandler{errs: make(chan error, 1)}, NewFixedLengthFrameCodec(4),
+			[]byte("abcd"), "half", ErrInvalidFixedLength, WithAsyncReact(true))
+	})
+}
+
+// 发送bad后，没有ErrorHandler时OnClosed应该收到expected；有ErrorHandler时OnError收到expected，
+// 之后发送的next仍然被回显
+func testCodecError(t *testing.T, events EventHandler, codec ICodec, next []byte, bad string, expected error,
+	opts ...Option) {
+	var errs, closed chan error
+	switch s := events.(type) {
+	case *testErrorServer:
+		s.closed = make(chan error, 1)
+		errs, closed = s.closed, s.closed
+	case *testErrorHandler:
+		s.closed = make(chan error, 1)
+		errs, closed = s.errs, s.closed
+	}
+	engine, err := Start(events, "tcp://127.0.0.1:0", append(opts, WithDisableSignalNotify(true), WithCodec(codec))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", engine.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(bad)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no codec error is reported")
+	}
+	if !errors.Is(err, expected) {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+	if next == nil {
+		return
+	}
+
+	if _, err = conn.Write(next); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(next))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, next) {
+		t.Fatalf("expected %q, got %q", next, got)
+	}
+	select {
+	case err = <-closed:
+		t.Fatalf("connection is closed: %v", err)
+	default:
+	}
+}
+
+// 不经过eventloop，直接用conn的接收缓冲区解码：inbound是之前剩下、已经在inboundBuffer中的数据，buffer是这次读到的数据
+func newTestDecodeConn(codec ICodec) *conn {
+	return &conn{codec: codec, inboundBuffer: prb.Get()}
+}
+
+func feedTestDecodeConn(c *conn, inbound, buffer []byte) {
+	_, _ = c.inboundBuffer.Write(inbound)
+	c.buffer = buffer
+}
+
+func TestLengthFieldBasedFrameCodecDecode(t *testing.T) {
+	codec := NewLengthFieldBasedFrameCodec(EncoderConfig{}, DecoderConfig{
+		ByteOrder: binary.BigEndian, LengthFieldOffset: 1, LengthFieldLength: 2, InitialBytesToStrip: 3,
+	})
+	frames := []string{"hello", "", "world!"}
+	var stream []byte
+	for _, f := range frames {
+		stream = append(stream, 0xff, 0, byte(len(f)))
+		stream = append(stream, f...)
+	}
+	// 在每个位置把数据分成inboundBuffer和c.buffer两部分
+	for i := 0; i <= len(stream); i++ {
+		c := newTestDecodeConn(codec)
+		feedTestDecodeConn(c, stream[:i], stream[i:])
+		for _, expected := range frames {
+			frame, err := c.read()
+			if err != nil {
+				t.Fatalf("split at %d: %v", i, err)
+			}
+			if string(frame) != expected {
+				t.Fatalf("split at %d: expected %q, got %q", i, expected, frame)
+			}
+		}
+		if frame, err := c.read(); frame != nil || !errors.Is(err, ErrIncompleteFrame) {
+			t.Fatalf("split at %d: unexpected frame %q, error %v", i, frame, err)
+		}
+		if n := c.BufferLength(); n != 0 {
+			t.Fatalf("split at %d: %d bytes left", i, n)
+		}
+		prb.Put(c.inboundBuffer)
+	}
+}
+
+// 长度字段超出int的范围、InitialBytesToStrip超过整帧时返回错误，不会溢出、panic
+func TestLengthFieldBasedFrameCodecInvalidLength(t *testing.T) {
+	cases := []struct {
+		name   string
+		config DecoderConfig
+		stream []byte
+		err    error
+	}{
+		{"max-int64", DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 8, InitialBytesToStrip: 8},
+			[]byte("\x7f\xff\xff\xff\xff\xff\xff\xffxy"), ErrFrameTooLarge},
+		{"max-uint64", DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 8},
+			[]byte("\xff\xff\xff\xff\xff\xff\xff\xffxy"), ErrFrameTooLarge},
+		{"adjustment", DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 8, LengthAdjustment: 16},
+			[]byte("\x7f\xff\xff\xff\xff\xff\xff\xf8xy"), ErrFrameTooLarge},
+		{"strip", DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 1, InitialBytesToStrip: 4},
+			[]byte("\x00xy"), ErrTooManyBytesToStrip},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestDecodeConn(NewLengthFieldBasedFrameCodec(EncoderConfig{}, tc.config))
+			defer prb.Put(c.inboundBuffer)
+			feedTestDecodeConn(c, nil, tc.stream)
+			if frame, err := c.read(); frame != nil || !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got frame %q, error %v", tc.err, frame, err)
+			}
+		})
+	}
+}
+
+// 多字节的分隔符分两次到达时，已经到达的开头不算在帧里，正好MaxFrameLength的帧不会被拒绝
+func TestDelimitedFrameSplitDelimiter(t *testing.T) {
+	crlf := NewMultiDelimiterBasedFrameCodec([]byte("\r\n\r\n"))
+	crlf.MaxFrameLength = 4
+	cases := []struct {
+		name        string
+		codec       ICodec
+		first, rest string
+		notFound    error
+	}{
+		{"line", &LineBasedFrameCodec{CRLF: true, MaxFrameLength: 4}, "abcd\r", "\n", ErrCRLFNotFound},
+		{"delimiter", crlf, "abcd\r\n\r", "\n", ErrDelimiterNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestDecodeConn(tc.codec)
+			defer prb.Put(c.inboundBuffer)
+			feedTestDecodeConn(c, nil, []byte(tc.first))
+			if frame, err := c.read(); frame != nil || err != tc.notFound {
+				t.Fatalf("expected %v, got frame %q, error %v", tc.notFound, frame, err)
+			}
+			feedTestDecodeConn(c, []byte(tc.first), []byte(tc.rest))
+			if frame, err := c.read(); string(frame) != "abcd" || err != nil {
+				t.Fatalf("expected %q, got frame %q, error %v", "abcd", frame, err)
+			}
+
+			// 去掉分隔符的开头之后仍然超过限制
+			c = newTestDecodeConn(tc.codec)
+			defer prb.Put(c.inboundBuffer)
+			feedTestDecodeConn(c, nil, []byte("e"+tc.first))
+			var tooLarge *FrameTooLargeError
+			if _, err := c.read(); !errors.As(err, &tooLarge) || tooLarge.Length != 5 {
+				t.Fatalf("expected a frame of length 5 to be too large, got %v", err)
+			}
+		})
+	}
+}
+
+// 改成ReadN之前的实现：Read合并inboundBuffer和c.buffer，再为每帧分配内存拷贝出来，作为benchmark的对照
+func decodeLengthFieldByRead(cc *LengthFieldBasedFrameCodec, c *conn) ([]byte, error) {
+	in := c.Read()
+	n := cc.decoderConfig.LengthFieldLength
+	if len(in) < n {
+		return nil, ErrUnexpectedEOF
+	}
+	msgLength := int(cc.getUnadjustedFrameLength(in[:n])) + cc.decoderConfig.LengthAdjustment
+	if len(in) < n+msgLength {
+		return nil, ErrUnexpectedEOF
+	}
+	fullMessage := make([]byte, n+msgLength)
+	copy(fullMessage, in[:n])
+	copy(fullMessage[n:], in[n:n+msgLength])
+	c.ShiftN(len(fullMessage))
+	return fullMessage[cc.decoderConfig.InitialBytesToStrip:], nil
+}
+
+func BenchmarkLengthFieldBasedFrameCodecDecode(b *testing.B) {
+	codec := NewLengthFieldBasedFrameCodec(EncoderConfig{}, DecoderConfig{
+		ByteOrder: binary.BigEndian, LengthFieldLength: 4, InitialBytesToStrip: 4,
+	})
+	frame := make([]byte, 4+1024)
+	binary.BigEndian.PutUint32(frame, 1024)
+	decoders := []struct {
+		name   string
+		decode func(c *conn) ([]byte, error)
+	}{
+		{"ReadN", func(c *conn) ([]byte, error) {
+			return c.read()
+		}},
+		{"Read", func(c *conn) ([]byte, error) {
+			defer c.releaseByteBuffer()
+			return decodeLengthFieldByRead(codec, c)
+		}},
+	}
+	for _, d := range decoders {
+		// 整帧都在这次读到的数据中
+		b.Run(d.name+"-whole", func(b *testing.B) {
+			benchmarkDecode(b, codec, d.decode, nil, frame)
+		})
+		// 长度字段的一部分在inboundBuffer中
+		b.Run(d.name+"-split", func(b *testing.B) {
+			benchmarkDecode(b, codec, d.decode, frame[:2], frame[2:])
+		})
+	}
+}
+
+func benchmarkDecode(b *testing.B, codec ICodec, decode func(c *conn) ([]byte, error), inbound, buffer []byte) {
+	c := newTestDecodeConn(codec)
+	defer prb.Put(c.inboundBuffer)
+	b.SetBytes(int64(len(inbound) + len(buffer)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		feedTestDecodeConn(c, inbound, buffer)
+		if frame, err := decode(c); err != nil || len(frame) != 1024 {
+			b.Fatalf("unexpected frame of %d bytes, error %v", len(frame), err)
+		}
+	}
+}
+
+// 按pieces分多次收到数据，每次像eventloop一样把没有解码的数据存入inboundBuffer，返回解码出的全部帧
+func decodePieces(t *testing.T, c *conn, pieces ...string) (frames []string) {
+	for _, p := range pieces {
+		_, _ = c.inboundBuffer.Write(c.buffer)
+		c.buffer = []byte(p)
+		for {
+			frame, err := c.read()
+			if err != nil && !errors.Is(err, ErrIncompleteFrame) {
+				t.Fatal(err)
+			}
+			if frame == nil {
+				break
+			}
+			frames = append(frames, string(frame))
+		}
+	}
+	return
+}
+
+func TestDelimiterCodecs(t *testing.T) {
+	multi := NewMultiDelimiterBasedFrameCodec([]byte("||"), []byte("\r\n"), []byte("\n"))
+	keep := NewMultiDelimiterBasedFrameCodec([]byte("||"), []byte("\r\n"), []byte("\n"))
+	keep.KeepDelimiter = true
+	cases := []struct {
+		name     string
+		codec    ICodec
+		pieces   []string
+		expected []string
+		encoded  string
+	}{
+		// 取最早出现的分隔符，\r\n在\n之前匹配
+		{"multi", multi, []string{"a\r\nb\nc||d|"}, []string{"a", "b", "c"}, "x||"},
+		{"multi-keep", keep, []string{"a\r\nb\nc||d|"}, []string{"a\r\n", "b\n", "c||"}, "x||"},
+		// 分隔符跨过两次读到的数据
+		{"multi-split", multi, []string{"ab|", "|cd\r", "\n", "e|", "|"}, []string{"ab", "cd", "e"}, "x||"},
+		{"single", NewDelimiterBasedFrameCodec('|'), []string{"a|b", "c|"}, []string{"a", "bc"}, "x|"},
+		{"line", &LineBasedFrameCodec{}, []string{"a\r\nb", "c\n"}, []string{"a\r", "bc"}, "x\n"},
+		// CRLF模式下只有\r\n是换行，单独的\n留在帧中
+		{"line-crlf", &LineBasedFrameCodec{CRLF: true}, []string{"a\r\nb", "c\n\r", "\n"}, []string{"a", "bc\n"},
+			"x\r\n"},
+		{"line-crlf-bare-lf", &LineBasedFrameCodec{CRLF: true}, []string{"a\nb\r\n"}, []string{"a\nb"}, "x\r\n"},
+		{"line-crlf-keep", &LineBasedFrameCodec{CRLF: true, KeepDelimiter: true}, []string{"a\r", "\nb\n\r\n"},
+			[]string{"a\r\n", "b\n\r\n"}, "x\r\n"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestDecodeConn(tc.codec)
+			defer prb.Put(c.inboundBuffer)
+			frames := decodePieces(t, c, tc.pieces...)
+			if fmt.Sprint(frames) != fmt.Sprint(tc.expected) || len(frames) != len(tc.expected) {
+				t.Fatalf("expected frames %q, got %q", tc.expected, frames)
+			}
+			encoded, err := tc.codec.Encode(c, []byte("x"))
+			if err != nil || string(encoded) != tc.encoded {
+				t.Fatalf("expected encoded %q, got %q, error %v", tc.encoded, encoded, err)
+			}
+		})
+	}
+
+	// 没有找到分隔符时记录查找过的位置，下次不再从头查找
+	t.Run("incremental", func(t *testing.T) {
+		c := newTestDecodeConn(multi)
+		defer prb.Put(c.inboundBuffer)
+		if frames := decodePieces(t, c, "abcdef|"); len(frames) != 0 {
+			t.Fatalf("unexpected frames %q", frames)
+		}
+		// 最长的分隔符是2个字节，最后1个字节还要再找一次
+		if c.scanned != 6 {
+			t.Fatalf("expected 6 bytes scanned, got %d", c.scanned)
+		}
+		if frames := decodePieces(t, c, "|gh"); len(frames) != 1 || frames[0] != "abcdef" {
+			t.Fatalf("unexpected frames %q", frames)
+		}
+		// 取出帧之后剩下的gh重新查找
+		if c.scanned != 1 {
+			t.Fatalf("expected 1 byte scanned, got %d", c.scanned)
+		}
+	})
+}
+
+func TestVarintLengthFrameCodec(t *testing.T) {
+	codec := &VarintLengthFrameCodec{MaxFrameLength: 1024}
+	long := strings.Repeat("x", 300)
+	var stream []byte
+	for _, f := range []string{"hello", "", long} {
+		frame, err := codec.Encode(nil, []byte(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, frame...)
+	}
+	// 300的varint是0xac 0x02，两个字节
+	if prefix := stream[len(stream)-len(long)-2 : len(stream)-len(long)]; !bytes.Equal(prefix, []byte{0xac, 0x02}) {
+		t.Fatalf("unexpected varint prefix %x", prefix)
+	}
+
+	// 在每个位置把数据拆成两次读到，包括拆开varint的位置
+	for i := 0; i <= len(stream); i++ {
+		c := newTestDecodeConn(codec)
+		frames := decodePieces(t, c, string(stream[:i]), string(stream[i:]))
+		if len(frames) != 3 || frames[0] != "hello" || frames[1] != "" || frames[2] != long {
+			t.Fatalf("split at %d: unexpected frames %q", i, frames)
+		}
+		if n := c.BufferLength(); n != 0 {
+			t.Fatalf("split at %d: %d bytes left", i, n)
+		}
+		prb.Put(c.inboundBuffer)
+	}
+
+	if _, err := codec.Encode(nil, make([]byte, 1025)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrFrameTooLarge, err)
+	}
+	c := newTestDecodeConn(codec)
+	defer prb.Put(c.inboundBuffer)
+	feedTestDecodeConn(c, nil, bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64+1))
+	if _, err := c.read(); err != ErrVarintOverflow {
+		t.Fatalf("expected %v, got %v", ErrVarintOverflow, err)
+	}
+
+	// 没有MaxFrameLength时，前缀加上长度超出int的范围也是溢出
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(maxInt))
+	c2 := newTestDecodeConn(new(VarintLengthFrameCodec))
+	defer prb.Put(c2.inboundBuffer)
+	feedTestDecodeConn(c2, nil, append(prefix[:n], "xy"...))
+	if frame, err := c2.read(); frame != nil || err != ErrVarintOverflow {
+		t.Fatalf("expected %v, got frame %q, error %v", ErrVarintOverflow, frame, err)
+	}
+}
+
+type testNoSpinHandler struct {
+	testErrorServer
+	errs     int32
+	reported chan struct{}
+}
+
+func (s *testNoSpinHandler) OnError(c Conn, err error) (action Action) {
+	if atomic.AddInt32(&s.errs, 1) == 1 {
+		close(s.reported)
+	}
+	return None
+}
+
+func testCodecErrorNoSpin(t *testing.T) {
+	codec := NewFixedLengthFrameCodec(8)
+	codec.MaxFrameLength = 4
+	events := &testNoSpinHandler{testErrorServer: testErrorServer{closed: make(chan error, 2)},
+		reported: make(chan struct{})}
+	engine, err := Start(events, "tcp://127.0.0.1:0", WithDisableSignalNotify(true), WithNumEventLoop(1),
+		WithCodec(codec), WithListeners(ListenerConfig{Addr: "tcp://127.0.0.1:0", Codec: &BuiltInFrameCodec{}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+	addrs := engine.Addrs()
+
+	bad, err := net.Dial("tcp", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	if _, err = bad.Write([]byte("12345678")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-events.reported:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnError was not called")
+	}
+
+	good, err := net.Dial("tcp", addrs[1].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+	if _, err = good.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	_ = good.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(good, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("expected %q, got %q", "ping", got)
+	}
+	// 每次读到数据只报告一次
+	if n := atomic.LoadInt32(&events.errs); n != 1 {
+		t.Fatalf("expected OnError to be called once, got %d", n)
+	}
+}
+
+// React中调用Read、ResetBuffer不会释放帧所在的缓冲区
+func TestFrameValidDuringReact(t *testing.T) {
+	codec := NewLengthFieldBasedFrameCodec(EncoderConfig{}, DecoderConfig{
+		ByteOrder: binary.BigEndian, LengthFieldLength: 1, InitialBytesToStrip: 1,
+	})
+	// 第一帧和第二帧的长度字段在inboundBuffer中，第一帧会被拷贝到byteBuffer
+	stream := []byte("\x05hello\x05world")
+	c := newTestDecodeConn(codec)
+	defer prb.Put(c.inboundBuffer)
+	feedTestDecodeConn(c, stream[:7], stream[7:])
+	frame, err := c.read()
+	if err != nil || string(frame) != "hello" {
+		t.Fatalf("unexpected frame %q, error %v", frame, err)
+	}
+
+	// 相当于React中的调用，之后从pool中取出的缓冲区不能是帧所在的那个
+	if buf := c.Read(); string(buf) != "\x05world" {
+		t.Fatalf("unexpected inbound data %q", buf)
+	}
+	c.ResetBuffer()
+	for i := 0; i < 4; i++ {
+		b := bytebuffer.Get()
+		_, _ = b.Write(bytes.Repeat([]byte{'x'}, 64))
+		defer bytebuffer.Put(b)
+	}
+	c.releaseByteBuffer()
+	if string(frame) != "hello" {
+		t.Fatalf("frame is overwritten: %q", frame)
+	}
+}
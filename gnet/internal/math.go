@@ -41,6 +41,7 @@ func fillBits(n int) int {
 	n |= n >> 4
 	n |= n >> 8
 	n |= n >> 16
-	n |= n >> 32
+	// 64位时是n >> 32；32位平台上再移16位，结果不变
+	n |= n >> (bitsize / 2)
 	return n
 }
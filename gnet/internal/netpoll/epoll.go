@@ -0,0 +1,274 @@
+//go:build linux
+// +build linux
+
+package netpoll
+
+import (
+	"log"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"golang_project_note/gnet/internal"
+)
+
+type Poller struct {
+	// epoll fd
+	fd int
+	// eventfd，用于唤醒 epoll_wait
+	wfd int
+	// 读取eventfd计数器的缓冲区
+	wfdBuf []byte
+	// 是否为边缘触发（EPOLLET）
+	et bool
+	// 不为nil时使用io_uring代替epoll
+	uring         *uring
+	asyncJobQueue internal.AsyncJobQueue
+}
+
+func OpenPoller() (poller *Poller, err error) {
+	poller = new(Poller)
+	if poller.fd, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC); err != nil {
+		poller = nil
+		return
+	}
+	// epoll没有kqueue的EVFILT_USER，用eventfd来代替：往wfd写入即可唤醒epoll_wait
+	if poller.wfd, err = unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC); err != nil {
+		_ = unix.Close(poller.fd)
+		poller = nil
+		return
+	}
+	poller.wfdBuf = make([]byte, 8)
+	if err = poller.AddRead(poller.wfd); err != nil {
+		_ = poller.Close()
+		poller = nil
+		return
+	}
+
+	poller.asyncJobQueue = internal.NewAsyncJobQueue()
+	return
+}
+
+// 边缘触发模式的poller，fd上的事件只会在状态变化时通知一次，
+// 所以调用方必须一直读/写到EAGAIN为止
+func OpenEdgeTriggeredPoller() (poller *Poller, err error) {
+	if poller, err = OpenPoller(); err == nil {
+		poller.et = true
+	}
+	return
+}
+
+// 使用io_uring的poller，提交accept/recv/send操作而不是等待fd就绪，
+// 内核不支持io_uring（或版本低于5.7）时自动退回到epoll
+func OpenIOUringPoller() (poller *Poller, err error) {
+	var u *uring
+	if u, err = openUring(); err != nil {
+		return OpenPoller()
+	}
+	poller = &Poller{fd: -1, uring: u}
+	// 由io_uring来读eventfd，所以不需要非阻塞
+	if poller.wfd, err = unix.Eventfd(0, unix.EFD_CLOEXEC); err != nil {
+		_ = u.close()
+		poller = nil
+		return
+	}
+	poller.wfdBuf = make([]byte, 8)
+	u.wfd, u.wfdBuf = poller.wfd, poller.wfdBuf
+	u.armWake()
+
+	poller.asyncJobQueue = internal.NewAsyncJobQueue()
+	return
+}
+
+func (p *Poller) Close() error {
+	if p.uring != nil {
+		if err := p.uring.close(); err != nil {
+			return err
+		}
+		return unix.Close(p.wfd)
+	}
+	if err := unix.Close(p.fd); err != nil {
+		return err
+	}
+	return unix.Close(p.wfd)
+}
+
+const (
+	readEvents      = unix.EPOLLPRI | unix.EPOLLIN
+	writeEvents     = unix.EPOLLOUT
+	readWriteEvents = readEvents | writeEvents
+)
+
+func (p *Poller) events(ev uint32) uint32 {
+	if p.et {
+		return ev | unix.EPOLLET
+	}
+	return ev
+}
+
+// io_uring模式下Write把数据放进有上限的发送队列，队列满时返回EAGAIN，腾出空间后会通知可写事件，
+// 不需要关注可写，所以AddReadWrite只是注册fd，Mod*什么都不做，暂停读由调用方不再调用Read实现；
+// AddWrite用于等待非阻塞connect完成，之后第一次Mod*开始recv
+func (p *Poller) AddRead(fd int) error {
+	if p.uring != nil {
+		return p.uring.addRead(fd)
+	}
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.events(readEvents)})
+}
+
+func (p *Poller) AddWrite(fd int) error {
+	if p.uring != nil {
+		return p.uring.addWrite(fd)
+	}
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.events(writeEvents)})
+}
+
+func (p *Poller) AddReadWrite(fd int) error {
+	if p.uring != nil {
+		return p.uring.addRead(fd)
+	}
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.events(readWriteEvents)})
+}
+
+// 只监听可读事件
+func (p *Poller) ModRead(fd int) error {
+	if p.uring != nil {
+		return p.uring.mod(fd)
+	}
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.events(readEvents)})
+}
+
+// 同时监听可读、可写事件
+func (p *Poller) ModReadWrite(fd int) error {
+	if p.uring != nil {
+		return p.uring.mod(fd)
+	}
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.events(readWriteEvents)})
+}
+
+// 只监听可写事件，暂停读的时候使用
+func (p *Poller) ModWrite(fd int) error {
+	if p.uring != nil {
+		return p.uring.mod(fd)
+	}
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.events(writeEvents)})
+}
+
+// 暂停读并且没有数据要写的时候使用，出错、挂断仍然会通知
+func (p *Poller) ModNone(fd int) error {
+	if p.uring != nil {
+		return p.uring.mod(fd)
+	}
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: p.events(0)})
+}
+
+// 与kqueue不同，需要手动将fd从epoll集合中移除
+func (p *Poller) Delete(fd int) error {
+	if p.uring != nil {
+		return p.uring.delete(fd)
+	}
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_DEL, fd, nil)
+}
+
+// io_uring模式下连接关闭之后，发送队列中剩下的数据还在发送；epoll模式下它们已经交给了内核
+func (p *Poller) Draining() bool {
+	return p.uring != nil && p.uring.flushing()
+}
+
+// Accept、Read、Write在epoll模式下就是普通的系统调用，
+// io_uring模式下则是取走已经完成的accept/recv，或把数据交给send
+func (p *Poller) Accept(fd int) (int, unix.Sockaddr, error) {
+	if p.uring != nil {
+		return p.uring.accept(fd)
+	}
+	return unix.Accept(fd)
+}
+
+func (p *Poller) Read(fd int, buf []byte) (int, error) {
+	if p.uring != nil {
+		return p.uring.read(fd, buf)
+	}
+	return unix.Read(fd, buf)
+}
+
+func (p *Poller) Write(fd int, buf []byte) (int, error) {
+	if p.uring != nil {
+		return p.uring.write(fd, buf)
+	}
+	return unix.Write(fd, buf)
+}
+
+// 超过MaxIovecs的部分不会写，和写了一部分的情况一样由调用方处理
+func (p *Poller) Writev(fd int, bufs [][]byte) (int, error) {
+	if len(bufs) > MaxIovecs {
+		bufs = bufs[:MaxIovecs]
+	}
+	if p.uring != nil {
+		return p.uring.writev(fd, bufs)
+	}
+	return unix.Writev(fd, bufs)
+}
+
+// 把infd从offset开始的count个字节发送到fd，出错（例如EAGAIN）时也可能已经发送了一部分，以返回的字节数为准
+func (p *Poller) SendFile(fd, infd int, offset int64, count int) (int, error) {
+	if p.uring != nil {
+		return p.uring.sendfile(fd, infd, offset, count)
+	}
+	n, err := unix.Sendfile(fd, infd, &offset, count)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// eventfd要求每次写入8字节的整数
+var (
+	u uint64 = 1
+	b        = (*(*[8]byte)(unsafe.Pointer(&u)))[:]
+)
+
+func (p *Poller) Trigger(job internal.Job) (err error) {
+	if p.asyncJobQueue.Push(job) == 1 {
+		_, err = unix.Write(p.wfd, b)
+	}
+	return
+}
+
+func (p *Poller) Polling(callback func(fd int, ev uint32) error) (err error) {
+	// 上次Polling因为任务出错返回时，剩下的任务还在队列里，不会再有唤醒事件
+	if err = p.asyncJobQueue.ForEach(); err != nil {
+		return
+	}
+	if p.uring != nil {
+		return p.uring.polling(p, callback)
+	}
+	el := newEventList(InitEvents)
+	var wakenUp bool
+	for {
+		n, err0 := unix.EpollWait(p.fd, el.events, -1)
+		if err0 != nil && err0 != unix.EINTR {
+			log.Println(err0)
+			continue
+		}
+		for i := 0; i < n; i++ {
+			if fd := int(el.events[i].Fd); fd != p.wfd {
+				if err = callback(fd, el.events[i].Events); err != nil {
+					return
+				}
+			} else {
+				wakenUp = true
+				// 读出计数器，否则eventfd会一直处于可读状态
+				_, _ = unix.Read(p.wfd, p.wfdBuf)
+			}
+		}
+
+		if wakenUp {
+			wakenUp = false
+			if err = p.asyncJobQueue.ForEach(); err != nil {
+				return
+			}
+		}
+		if n == el.size {
+			el.increase()
+		}
+	}
+}
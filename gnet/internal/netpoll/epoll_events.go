@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package netpoll
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const (
+	InitEvents = 128
+	// 一次writev最多的缓冲区数量（IOV_MAX）
+	MaxIovecs = 1024
+	// 出错、对端关闭（包括半关闭）
+	ErrEvents = unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLRDHUP
+	// 可写事件，出错时也需要处理
+	OutEvents = ErrEvents | unix.EPOLLOUT
+	// 可读事件，出错时也需要处理
+	InEvents = ErrEvents | unix.EPOLLIN | unix.EPOLLPRI
+)
+
+type eventList struct {
+	size   int
+	events []unix.EpollEvent
+}
+
+func newEventList(size int) *eventList {
+	return &eventList{
+		size:   size,
+		events: make([]unix.EpollEvent, size),
+	}
+}
+
+// 只有在events都处理完之后才会调用，所以不需要迁移数据
+func (el *eventList) increase() {
+	el.size <<= 1
+	el.events = make([]unix.EpollEvent, el.size)
+}
@@ -0,0 +1,783 @@
+//go:build linux
+// +build linux
+
+package netpoll
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// io_uring的内核ABI，x/sys/unix里还没有对应的定义
+const (
+	uringEntries = 1024
+	// 每个连接的recv缓冲区大小
+	uringRecvBufSize = 0x4000
+	// 每个连接发送队列的上限，相当于socket的发送缓冲区，满了之后写返回EAGAIN，剩下的数据留在调用方
+	uringSendBufSize = 0x10000
+
+	uringOffSQRing = 0
+	uringOffSQEs   = 0x10000000
+
+	uringFeatSingleMmap = 1 << 0
+	uringFeatNoDrop     = 1 << 1
+	uringFeatFastPoll   = 1 << 5
+
+	uringEnterGetEvents = 1 << 0
+
+	uringSqeIOLink = 1 << 2
+
+	uringOpPollAdd     = 6
+	uringOpAccept      = 13
+	uringOpAsyncCancel = 14
+	uringOpRead        = 22
+	uringOpSend        = 26
+	uringOpRecv        = 27
+)
+
+type uringSQRingOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	resv2                                                           uint64
+}
+
+type uringCQRingOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	resv2                                                           uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSQRingOffsets
+	cqOff                                                                  uringCQRingOffsets
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	pad         [2]uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// fd在io_uring中的使用方式
+const (
+	// 只等待可读（POLL_ADD），由调用方自己读，用于UDP这类需要对端地址的socket
+	uringModePoll = iota
+	// 监听socket，提交accept
+	uringModeAccept
+	// 流式socket，提交recv/send
+	uringModeStream
+	// 正在非阻塞connect的socket，等待可写（POLLOUT），连接建立后由mod切换到uringModeStream
+	uringModeConnect
+)
+
+// 提交到io_uring中的操作类型
+const (
+	uringOpKindWake = iota
+	uringOpKindPoll
+	uringOpKindAccept
+	uringOpKindRecv
+	uringOpKindSend
+	uringOpKindWritable
+	uringOpKindLink
+	uringOpKindCancel
+)
+
+type uringFD struct {
+	fd     int
+	mode   int
+	closed bool
+	// 进行中的accept/recv/poll操作id，以及它前面串联的poll，0表示没有
+	readOp   uint64
+	readLink uint64
+	// 已完成、还没被取走的accept
+	accepted []int
+	// recv的缓冲区，pending为其中还没被读走的数据
+	rbuf    []byte
+	pending []byte
+	eof     bool
+	// 出错后所有读写都会返回该错误
+	err error
+	// 进行中的send操作id；sending为正在发送的缓冲区，sent为其中已经发送的字节数，
+	// sendq为排队等待下一次send的数据，两个缓冲区轮流使用
+	sendOp  uint64
+	sending []byte
+	sent    int
+	sendq   []byte
+	// 进行中的等待可写的poll操作id，sendfile直接写socket没写完时使用
+	writeOp uint64
+	// 写返回过EAGAIN或者只写了一部分，发送队列腾出空间后要通知可写事件
+	wantWrite bool
+}
+
+// 发送队列剩余的空间
+func (f *uringFD) sendRoom() int {
+	return uringSendBufSize - (len(f.sending) - f.sent) - len(f.sendq)
+}
+
+// 还有没取走的recv结果
+func (f *uringFD) readable() bool {
+	return len(f.pending) > 0 || f.eof || f.err != nil
+}
+
+type uringOp struct {
+	kind int
+	f    *uringFD
+	// 保持对缓冲区的引用，防止内核写入期间被GC回收
+	buf []byte
+}
+
+type uring struct {
+	fd int
+	// SQ、CQ共用的映射区域（IORING_FEAT_SINGLE_MMAP）
+	rings   []byte
+	sqeMem  []byte
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqCap   uint32
+	sqArray []uint32
+	sqes    []uringSQE
+	cqHead  *uint32
+	cqTail  *uint32
+	cqMask  uint32
+	cqes    []uringCQE
+	// 本地的tail，在enter时才同步给内核
+	tail     uint32
+	toSubmit uint32
+
+	fds    map[int]*uringFD
+	ops    map[uint64]*uringOp
+	nextID uint64
+	// 已经delete、还在发送剩余数据的fd，key为dup出来的fd，发完后关闭
+	draining map[int]*uringFD
+	// 已经从CQ中取出、还没处理的完成事件，SQ满了要提交时先把CQ腾空
+	reaped []uringCQE
+	// enter出现无法恢复的错误后ring不能再使用，之后的操作都返回该错误
+	err error
+
+	wfd    int
+	wfdBuf []byte
+}
+
+func openUring() (u *uring, err error) {
+	var params uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uringEntries, uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	u = &uring{
+		fd:       int(fd),
+		fds:      make(map[int]*uringFD),
+		ops:      make(map[uint64]*uringOp),
+		draining: make(map[int]*uringFD),
+	}
+	// FAST_POLL（5.7+）保证socket上的accept/recv/send未就绪时由内核挂起重试，而不是直接返回EAGAIN
+	need := uint32(uringFeatSingleMmap | uringFeatNoDrop | uringFeatFastPoll)
+	if params.features&need != need {
+		_ = unix.Close(u.fd)
+		return nil, unix.ENOSYS
+	}
+
+	size := params.sqOff.array + params.sqEntries*4
+	if cqSize := params.cqOff.cqes + params.cqEntries*uint32(unsafe.Sizeof(uringCQE{})); cqSize > size {
+		size = cqSize
+	}
+	prot, flags := unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE
+	if u.rings, err = unix.Mmap(u.fd, uringOffSQRing, int(size), prot, flags); err != nil {
+		_ = unix.Close(u.fd)
+		return nil, err
+	}
+	if u.sqeMem, err = unix.Mmap(u.fd, uringOffSQEs, int(params.sqEntries)*int(unsafe.Sizeof(uringSQE{})), prot, flags); err != nil {
+		_ = unix.Munmap(u.rings)
+		_ = unix.Close(u.fd)
+		return nil, err
+	}
+
+	u.sqHead = (*uint32)(unsafe.Pointer(&u.rings[params.sqOff.head]))
+	u.sqTail = (*uint32)(unsafe.Pointer(&u.rings[params.sqOff.tail]))
+	u.sqMask = *(*uint32)(unsafe.Pointer(&u.rings[params.sqOff.ringMask]))
+	u.sqCap = params.sqEntries
+	u.sqArray = (*[1 << 20]uint32)(unsafe.Pointer(&u.rings[params.sqOff.array]))[:params.sqEntries:params.sqEntries]
+	u.sqes = (*[1 << 20]uringSQE)(unsafe.Pointer(&u.sqeMem[0]))[:params.sqEntries:params.sqEntries]
+	u.cqHead = (*uint32)(unsafe.Pointer(&u.rings[params.cqOff.head]))
+	u.cqTail = (*uint32)(unsafe.Pointer(&u.rings[params.cqOff.tail]))
+	u.cqMask = *(*uint32)(unsafe.Pointer(&u.rings[params.cqOff.ringMask]))
+	u.cqes = (*[1 << 20]uringCQE)(unsafe.Pointer(&u.rings[params.cqOff.cqes]))[:params.cqEntries:params.cqEntries]
+	u.tail = atomic.LoadUint32(u.sqTail)
+	return
+}
+
+// 进行中的操作引用着Go的缓冲区（rbuf、sending等），内核随时可能读写它们，所以要先取消所有操作、
+// 等到它们都完成之后才能释放ring。delete之后还没发完的数据也会被取消，Stop会等它们发完，见Draining
+func (u *uring) close() error {
+	ids := make([]uint64, 0, len(u.ops))
+	for id, op := range u.ops {
+		if op.kind != uringOpKindCancel {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		u.submitCancel(id)
+	}
+	if u.wfdBuf != nil {
+		// 读eventfd的操作不一定能被取消，写一次让它完成
+		_, _ = unix.Write(u.wfd, b)
+	}
+	for {
+		// polling出错返回时可能还有没处理的完成事件
+		u.reap()
+		for _, cqe := range u.reaped {
+			if op, ok := u.ops[cqe.userData]; ok {
+				delete(u.ops, cqe.userData)
+				if op.kind == uringOpKindAccept && cqe.res >= 0 {
+					_ = unix.Close(int(cqe.res))
+				}
+			}
+		}
+		u.reaped = u.reaped[:0]
+		if u.err != nil || len(u.ops) == 0 {
+			break
+		}
+		if err := u.enter(true); err != nil && !temporary(err) {
+			u.err = err
+		}
+	}
+	if len(u.ops) > 0 {
+		// 没法确认内核已经不再使用这些缓冲区，宁可泄漏ring也不能让它们被回收
+		abandoned.Lock()
+		abandoned.rings = append(abandoned.rings, u)
+		abandoned.Unlock()
+		return u.err
+	}
+
+	_ = unix.Munmap(u.sqeMem)
+	_ = unix.Munmap(u.rings)
+	err := unix.Close(u.fd)
+	for _, f := range u.fds {
+		for _, nfd := range f.accepted {
+			_ = unix.Close(nfd)
+		}
+	}
+	for fd := range u.draining {
+		_ = unix.Close(fd)
+	}
+	return err
+}
+
+// close时还有操作没完成的ring，保持引用直到进程退出
+var abandoned struct {
+	sync.Mutex
+	rings []*uring
+}
+
+// 可以重试的enter错误：EBUSY是CQ溢出，需要先取走完成事件；EAGAIN是内核暂时分配不出请求
+func temporary(err error) bool {
+	return err == unix.EINTR || err == unix.EBUSY || err == unix.EAGAIN
+}
+
+// 把SQ中的操作提交给内核，wait为true时会阻塞到至少有一个操作完成
+func (u *uring) enter(wait bool) error {
+	atomic.StoreUint32(u.sqTail, u.tail)
+	var minComplete, flags uintptr
+	if wait {
+		minComplete, flags = 1, uringEnterGetEvents
+	}
+	n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(u.fd), uintptr(u.toSubmit), minComplete, flags, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	u.toSubmit -= uint32(n)
+	return nil
+}
+
+// 把CQ中的完成事件都取出来放到reaped中，归还CQ的位置
+func (u *uring) reap() {
+	tail := atomic.LoadUint32(u.cqTail)
+	for head := atomic.LoadUint32(u.cqHead); head != tail; head++ {
+		u.reaped = append(u.reaped, u.cqes[head&u.cqMask])
+	}
+	atomic.StoreUint32(u.cqHead, tail)
+}
+
+// 预留n个SQE，SQ满了就先提交；CQ满了内核会拒绝提交（EBUSY），所以每次提交之后都把CQ腾空。
+// 无法恢复的错误会记录在u.err中，返回false
+func (u *uring) reserve(n uint32) bool {
+	for u.err == nil && u.tail-atomic.LoadUint32(u.sqHead)+n > u.sqCap {
+		if err := u.enter(false); err != nil && !temporary(err) {
+			u.err = err
+		}
+		u.reap()
+	}
+	return u.err == nil
+}
+
+// ring出错后不再提交，返回0，调用方之后会从addRead、polling等得到u.err
+func (u *uring) push(op *uringOp, sqe uringSQE) uint64 {
+	if !u.reserve(1) {
+		return 0
+	}
+	u.nextID++
+	u.ops[u.nextID] = op
+	sqe.userData = u.nextID
+	idx := u.tail & u.sqMask
+	u.sqes[idx] = sqe
+	u.sqArray[idx] = idx
+	u.tail++
+	u.toSubmit++
+	return u.nextID
+}
+
+func bufAddr(b []byte) uint64 {
+	return uint64(uintptr(unsafe.Pointer(&b[0])))
+}
+
+func (u *uring) armWake() {
+	u.push(&uringOp{kind: uringOpKindWake, buf: u.wfdBuf}, uringSQE{
+		opcode: uringOpRead, fd: int32(u.wfd), addr: bufAddr(u.wfdBuf), len: uint32(len(u.wfdBuf)),
+	})
+}
+
+// pollFirst：内核返回过EAGAIN，先挂一个poll等fd就绪再执行真正的操作，两者通过IOSQE_IO_LINK串起来
+func (u *uring) link(f *uringFD, events uint32, pollFirst bool) uint64 {
+	if !pollFirst || !u.reserve(2) {
+		return 0
+	}
+	return u.push(&uringOp{kind: uringOpKindLink, f: f}, uringSQE{
+		opcode: uringOpPollAdd, flags: uringSqeIOLink, fd: int32(f.fd), opFlags: events,
+	})
+}
+
+func (u *uring) submitPoll(f *uringFD) {
+	f.readOp = u.push(&uringOp{kind: uringOpKindPoll, f: f}, uringSQE{
+		opcode: uringOpPollAdd, fd: int32(f.fd), opFlags: unix.POLLIN,
+	})
+}
+
+func (u *uring) submitAccept(f *uringFD, pollFirst bool) {
+	f.readLink = u.link(f, unix.POLLIN, pollFirst)
+	f.readOp = u.push(&uringOp{kind: uringOpKindAccept, f: f}, uringSQE{
+		opcode: uringOpAccept, fd: int32(f.fd), opFlags: unix.SOCK_NONBLOCK | unix.SOCK_CLOEXEC,
+	})
+}
+
+func (u *uring) submitRecv(f *uringFD, pollFirst bool) {
+	f.readLink = u.link(f, unix.POLLIN, pollFirst)
+	f.readOp = u.push(&uringOp{kind: uringOpKindRecv, f: f, buf: f.rbuf}, uringSQE{
+		opcode: uringOpRecv, fd: int32(f.fd), addr: bufAddr(f.rbuf), len: uint32(len(f.rbuf)),
+	})
+}
+
+func (u *uring) submitSend(f *uringFD, pollFirst bool) {
+	if f.sent == len(f.sending) {
+		// 上一个缓冲区发完了，和发送队列交换
+		f.sending, f.sendq, f.sent = f.sendq, f.sending[:0], 0
+	}
+	buf := f.sending[f.sent:]
+	u.link(f, unix.POLLOUT, pollFirst)
+	f.sendOp = u.push(&uringOp{kind: uringOpKindSend, f: f, buf: buf}, uringSQE{
+		opcode: uringOpSend, fd: int32(f.fd), addr: bufAddr(buf), len: uint32(len(buf)),
+		opFlags: unix.MSG_WAITALL | unix.MSG_NOSIGNAL,
+	})
+}
+
+func (u *uring) submitWritable(f *uringFD) {
+	f.writeOp = u.push(&uringOp{kind: uringOpKindWritable, f: f}, uringSQE{
+		opcode: uringOpPollAdd, fd: int32(f.fd), opFlags: unix.POLLOUT,
+	})
+}
+
+func (u *uring) submitCancel(id uint64) {
+	u.push(&uringOp{kind: uringOpKindCancel}, uringSQE{opcode: uringOpAsyncCancel, addr: id})
+}
+
+func (u *uring) addRead(fd int) error {
+	if u.err != nil {
+		return u.err
+	}
+	if _, ok := u.fds[fd]; ok {
+		return unix.EEXIST
+	}
+	f := &uringFD{fd: fd}
+	if v, _ := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN); v == 1 {
+		f.mode = uringModeAccept
+		u.submitAccept(f, false)
+	} else if v, _ = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE); v == unix.SOCK_STREAM {
+		f.mode = uringModeStream
+		f.rbuf = make([]byte, uringRecvBufSize)
+		u.submitRecv(f, false)
+	} else {
+		u.submitPoll(f)
+	}
+	u.fds[fd] = f
+	return nil
+}
+
+func (u *uring) addWrite(fd int) error {
+	if u.err != nil {
+		return u.err
+	}
+	if _, ok := u.fds[fd]; ok {
+		return unix.EEXIST
+	}
+	f := &uringFD{fd: fd, mode: uringModeConnect}
+	f.readOp = u.push(&uringOp{kind: uringOpKindPoll, f: f}, uringSQE{
+		opcode: uringOpPollAdd, fd: int32(fd), opFlags: unix.POLLOUT,
+	})
+	u.fds[fd] = f
+	return nil
+}
+
+func (u *uring) mod(fd int) error {
+	f, ok := u.fds[fd]
+	if !ok {
+		return unix.ENOENT
+	}
+	if f.mode == uringModeConnect && f.readOp == 0 {
+		// connect已经完成，开始recv
+		f.mode = uringModeStream
+		f.rbuf = make([]byte, uringRecvBufSize)
+		u.submitRecv(f, false)
+	}
+	return nil
+}
+
+// 调用方会紧接着关闭fd，所以这里必须马上提交：取消进行中的读和poll；发送队列中的数据
+// 已经当作写成功返回给了调用方，dup一份fd继续发送，发完再关闭。优雅关闭会等它们发完（Draining），
+// 强制关闭时和连接上其他没发完的数据一样被丢弃
+func (u *uring) delete(fd int) error {
+	f, ok := u.fds[fd]
+	if !ok {
+		return unix.ENOENT
+	}
+	delete(u.fds, fd)
+	f.closed = true
+	if f.readLink != 0 {
+		u.submitCancel(f.readLink)
+	}
+	if f.readOp != 0 {
+		u.submitCancel(f.readOp)
+	}
+	if f.writeOp != 0 {
+		u.submitCancel(f.writeOp)
+	}
+	if f.err == nil && (f.sendOp != 0 || len(f.sendq) > 0) {
+		if nfd, err := unix.Dup(fd); err == nil {
+			unix.CloseOnExec(nfd)
+			// 进行中的send持有socket的引用，不受fd关闭的影响，之后的send使用dup出来的fd
+			f.fd = nfd
+			u.draining[nfd] = f
+			if f.sendOp == 0 {
+				u.submitSend(f, false)
+			}
+		}
+	}
+	for _, nfd := range f.accepted {
+		_ = unix.Close(nfd)
+	}
+	if err := u.enter(false); err != nil && !temporary(err) {
+		return err
+	}
+	return nil
+}
+
+func (u *uring) accept(fd int) (int, unix.Sockaddr, error) {
+	f, ok := u.fds[fd]
+	if !ok || f.mode != uringModeAccept {
+		return unix.Accept(fd)
+	}
+	if f.err != nil {
+		err := f.err
+		f.err = nil
+		u.submitAccept(f, false)
+		return -1, nil, err
+	}
+	if len(f.accepted) == 0 {
+		return -1, nil, unix.EAGAIN
+	}
+	nfd := f.accepted[0]
+	if f.accepted = f.accepted[1:]; len(f.accepted) == 0 {
+		u.submitAccept(f, false)
+	}
+	sa, err := unix.Getpeername(nfd)
+	if err != nil {
+		// 对端在取走之前就已经断开了，当作没有新连接
+		_ = unix.Close(nfd)
+		return -1, nil, unix.EAGAIN
+	}
+	return nfd, sa, nil
+}
+
+func (u *uring) read(fd int, buf []byte) (int, error) {
+	f, ok := u.fds[fd]
+	if !ok || f.mode != uringModeStream {
+		return unix.Read(fd, buf)
+	}
+	if len(f.pending) > 0 {
+		n := copy(buf, f.pending)
+		if f.pending = f.pending[n:]; len(f.pending) == 0 {
+			u.submitRecv(f, false)
+		}
+		return n, nil
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.eof {
+		return 0, nil
+	}
+	return 0, unix.EAGAIN
+}
+
+// 数据拷贝到发送队列后立即返回，和非阻塞socket一样，只返回队列能放下的字节数，队列满了返回EAGAIN，
+// 腾出空间后通知可写事件；同一个fd同时只会有一个send在进行，保证数据的顺序
+func (u *uring) write(fd int, buf []byte) (int, error) {
+	f, ok := u.fds[fd]
+	if !ok || f.mode != uringModeStream {
+		return unix.Write(fd, buf)
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	n := f.sendRoom()
+	if n > len(buf) {
+		n = len(buf)
+	}
+	f.sendq = append(f.sendq, buf[:n]...)
+	return u.queued(f, n, len(buf))
+}
+
+// 和write一样拷贝到发送队列，多个缓冲区合并成一次send
+func (u *uring) writev(fd int, bufs [][]byte) (int, error) {
+	f, ok := u.fds[fd]
+	if !ok || f.mode != uringModeStream {
+		return unix.Writev(fd, bufs)
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	n, expected := 0, 0
+	for _, buf := range bufs {
+		expected += len(buf)
+		if room := f.sendRoom(); room < len(buf) {
+			buf = buf[:room]
+		}
+		f.sendq = append(f.sendq, buf...)
+		n += len(buf)
+	}
+	if expected == 0 {
+		return 0, nil
+	}
+	return u.queued(f, n, expected)
+}
+
+// 放进发送队列n个字节之后提交send，没有全部放下时等队列腾出空间后通知可写
+func (u *uring) queued(f *uringFD, n, expected int) (int, error) {
+	if n < expected {
+		f.wantWrite = true
+	}
+	if n == 0 {
+		return 0, unix.EAGAIN
+	}
+	if f.sendOp == 0 {
+		u.submitSend(f, false)
+	}
+	return n, nil
+}
+
+// 发送队列为空时直接用sendfile写socket，是零拷贝的；队列中还有数据时要等它们发完，返回EAGAIN。
+// 没有写完时提交一个poll，socket可写时通知
+func (u *uring) sendfile(fd, infd int, offset int64, count int) (int, error) {
+	f, ok := u.fds[fd]
+	if ok = ok && f.mode == uringModeStream; ok {
+		if f.err != nil {
+			return 0, f.err
+		}
+		if f.sendOp != 0 {
+			f.wantWrite = true
+			return 0, unix.EAGAIN
+		}
+	}
+	n, err := unix.Sendfile(fd, infd, &offset, count)
+	if n < 0 {
+		n = 0
+	}
+	if ok && f.writeOp == 0 && (err == unix.EAGAIN || err == nil && n > 0 && n < count) {
+		u.submitWritable(f)
+	}
+	return n, err
+}
+
+// 处理完成的操作，返回需要通知给调用方的事件，0表示不需要通知
+func (u *uring) complete(op *uringOp, res int32) uint32 {
+	f := op.f
+	switch op.kind {
+	case uringOpKindPoll:
+		f.readOp, f.readLink = 0, 0
+		if f.closed || res < 0 {
+			return 0
+		}
+		return uint32(res)
+	case uringOpKindAccept:
+		f.readOp, f.readLink = 0, 0
+		if f.closed {
+			if res >= 0 {
+				_ = unix.Close(int(res))
+			}
+			return 0
+		}
+		switch {
+		case res >= 0:
+			f.accepted = append(f.accepted, int(res))
+		case unix.Errno(-res) == unix.EAGAIN:
+			u.submitAccept(f, true)
+			return 0
+		default:
+			f.err = unix.Errno(-res)
+		}
+		return unix.EPOLLIN
+	case uringOpKindRecv:
+		f.readOp, f.readLink = 0, 0
+		if f.closed {
+			return 0
+		}
+		switch {
+		case res > 0:
+			f.pending = f.rbuf[:res]
+			return unix.EPOLLIN
+		case res == 0:
+			f.eof = true
+			return unix.EPOLLIN | unix.EPOLLRDHUP
+		case unix.Errno(-res) == unix.EAGAIN:
+			u.submitRecv(f, true)
+			return 0
+		}
+		f.err = unix.Errno(-res)
+		return unix.EPOLLERR
+	case uringOpKindSend:
+		f.sendOp = 0
+		if f.closed && u.draining[f.fd] != f {
+			// delete时没能dup，fd已经关闭，不能再提交send
+			return 0
+		}
+		switch {
+		case res >= 0:
+			if f.sent += int(res); f.sent < len(f.sending) || len(f.sendq) > 0 {
+				u.submitSend(f, false)
+			}
+		case unix.Errno(-res) == unix.EAGAIN:
+			u.submitSend(f, true)
+			return 0
+		default:
+			f.err = unix.Errno(-res)
+		}
+		if f.closed {
+			// delete之后剩下的数据发完或者出错了，关闭dup出来的fd
+			if f.sendOp == 0 && u.draining[f.fd] == f {
+				delete(u.draining, f.fd)
+				_ = unix.Close(f.fd)
+			}
+			return 0
+		}
+		if f.err != nil {
+			return unix.EPOLLERR
+		}
+		return u.writable(f)
+	case uringOpKindWritable:
+		f.writeOp = 0
+		if f.closed || res < 0 {
+			return 0
+		}
+		f.wantWrite = true
+		return u.writable(f)
+	}
+	return 0
+}
+
+// 还有delete之后没发完的数据
+func (u *uring) flushing() bool {
+	return len(u.draining) > 0
+}
+
+// 发送队列腾出了空间，调用方之前没写完的话通知可写。可写和可读一起通知：有数据要写时
+// 调用方会忽略单独的可读事件，而recv的结果被取走之前不会再有新的可读事件
+func (u *uring) writable(f *uringFD) uint32 {
+	var ev uint32
+	if f.wantWrite {
+		f.wantWrite = false
+		ev = unix.EPOLLOUT
+	}
+	if f.readable() {
+		ev |= unix.EPOLLIN
+	}
+	return ev
+}
+
+func (u *uring) polling(p *Poller, callback func(fd int, ev uint32) error) (err error) {
+	var wakenUp bool
+	for {
+		if u.err != nil {
+			return u.err
+		}
+		// EBUSY时也要继续取走完成事件，否则会一直失败；上次polling还有没处理完的就不用等
+		if err = u.enter(len(u.reaped) == 0); err != nil && !temporary(err) {
+			return err
+		}
+		err = nil
+		// 先把CQE都取出来归还位置，回调中可能会继续提交操作，提交时也可能往reaped中追加
+		u.reap()
+		for i := 0; i < len(u.reaped); i++ {
+			cqe := u.reaped[i]
+			op, ok := u.ops[cqe.userData]
+			if !ok {
+				continue
+			}
+			delete(u.ops, cqe.userData)
+			if op.kind == uringOpKindWake {
+				wakenUp = true
+				u.armWake()
+				continue
+			}
+			if ev := u.complete(op, cqe.res); ev != 0 {
+				if err = callback(op.f.fd, ev); err != nil {
+					// 剩下的留到下次polling处理
+					u.reaped = append(u.reaped[:0], u.reaped[i+1:]...)
+					return
+				}
+				// poll是一次性的，处理完之后需要重新注册（水平触发）
+				if op.kind == uringOpKindPoll && !op.f.closed && op.f.readOp == 0 {
+					u.submitPoll(op.f)
+				}
+			}
+		}
+		u.reaped = u.reaped[:0]
+
+		if wakenUp {
+			wakenUp = false
+			if err = p.asyncJobQueue.ForEach(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -1,3 +1,6 @@
+//go:build freebsd || dragonfly || darwin
+// +build freebsd dragonfly darwin
+
 package netpoll
 
 import (
@@ -8,7 +11,9 @@ import (
 )
 
 type Poller struct {
-	fd            int
+	fd int
+	// 是否为边缘触发（EV_CLEAR）
+	et            bool
 	asyncJobQueue internal.AsyncJobQueue
 }
 
@@ -36,22 +41,46 @@ func OpenPoller() (poller *Poller, err error) {
 	return
 }
 
+// 边缘触发模式的poller，fd上的事件只会在状态变化时通知一次，
+// 所以调用方必须一直读/写到EAGAIN为止
+func OpenEdgeTriggeredPoller() (poller *Poller, err error) {
+	if poller, err = OpenPoller(); err == nil {
+		poller.et = true
+	}
+	return
+}
+
+// io_uring只有linux才有，直接使用kqueue
+func OpenIOUringPoller() (poller *Poller, err error) {
+	return OpenPoller()
+}
+
 func (p *Poller) Close() error {
 	return unix.Close(p.fd)
 }
 
+// EV_CLEAR：事件被取走后重置状态，即边缘触发
+func (p *Poller) addFlags() uint16 {
+	if p.et {
+		return unix.EV_ADD | unix.EV_CLEAR
+	}
+	return unix.EV_ADD
+}
+
 func (p *Poller) AddRead(fd int) error {
 	if _, err := unix.Kevent(p.fd, []unix.Kevent_t{
-		{Ident: uint64(fd), Filter: unix.EVFILT_READ, Flags: unix.EV_ADD},
+		{Ident: uint64(fd), Filter: unix.EVFILT_READ, Flags: p.addFlags()},
 	}, nil, nil); err != nil {
 		return err
 	}
 	return nil
 }
 
+// 等待非阻塞connect完成时使用，可读事件先注册但不启用，之后由ModRead等启用
 func (p *Poller) AddWrite(fd int) error {
 	if _, err := unix.Kevent(p.fd, []unix.Kevent_t{
-		{Ident: uint64(fd), Filter: unix.EVFILT_WRITE, Flags: unix.EV_ADD},
+		{Ident: uint64(fd), Filter: unix.EVFILT_READ, Flags: p.addFlags() | unix.EV_DISABLE},
+		{Ident: uint64(fd), Filter: unix.EVFILT_WRITE, Flags: p.addFlags()},
 	}, nil, nil); err != nil {
 		return err
 	}
@@ -60,28 +89,39 @@ func (p *Poller) AddWrite(fd int) error {
 
 func (p *Poller) AddReadWrite(fd int) error {
 	if _, err := unix.Kevent(p.fd, []unix.Kevent_t{
-		{Ident: uint64(fd), Filter: unix.EVFILT_READ, Flags: unix.EV_ADD},
-		{Ident: uint64(fd), Filter: unix.EVFILT_WRITE, Flags: unix.EV_ADD},
+		{Ident: uint64(fd), Filter: unix.EVFILT_READ, Flags: p.addFlags()},
+		{Ident: uint64(fd), Filter: unix.EVFILT_WRITE, Flags: p.addFlags()},
 	}, nil, nil); err != nil {
 		return err
 	}
 	return nil
 }
 
-// 只注册可读事件（可读一直存在），所以需要删除可写事件
+// 可读事件在AddRead时注册，之后只通过EV_ENABLE/EV_DISABLE暂停、恢复；
+// 可写事件则按需添加、删除。EV_DELETE一个不存在的filter会返回ENOENT，所以总是放在最后
 func (p *Poller) ModRead(fd int) error {
-	if _, err := unix.Kevent(p.fd, []unix.Kevent_t{
-		{Ident: uint64(fd), Filter: unix.EVFILT_WRITE, Flags: unix.EV_DELETE},
-	}, nil, nil); err != nil {
-		return err
-	}
-	return nil
+	return p.mod(fd, unix.EV_ENABLE, unix.EV_DELETE)
 }
 
 // 注册可读、可写事件
 func (p *Poller) ModReadWrite(fd int) error {
+	return p.mod(fd, unix.EV_ENABLE, p.addFlags())
+}
+
+// 只监听可写事件，暂停读的时候使用
+func (p *Poller) ModWrite(fd int) error {
+	return p.mod(fd, unix.EV_DISABLE, p.addFlags())
+}
+
+// 暂停读并且没有数据要写的时候使用
+func (p *Poller) ModNone(fd int) error {
+	return p.mod(fd, unix.EV_DISABLE, unix.EV_DELETE)
+}
+
+func (p *Poller) mod(fd int, readFlags, writeFlags uint16) error {
 	if _, err := unix.Kevent(p.fd, []unix.Kevent_t{
-		{Ident: uint64(fd), Filter: unix.EVFILT_WRITE, Flags: unix.EV_ADD},
+		{Ident: uint64(fd), Filter: unix.EVFILT_READ, Flags: readFlags},
+		{Ident: uint64(fd), Filter: unix.EVFILT_WRITE, Flags: writeFlags},
 	}, nil, nil); err != nil {
 		return err
 	}
@@ -94,6 +134,40 @@ func (p *Poller) Delete(fd int) error {
 	return nil
 }
 
+// 没发完的数据都在内核的发送缓冲区中，由内核在fd关闭后继续发送
+func (p *Poller) Draining() bool {
+	return false
+}
+
+func (p *Poller) Accept(fd int) (int, unix.Sockaddr, error) {
+	return unix.Accept(fd)
+}
+
+func (p *Poller) Read(fd int, buf []byte) (int, error) {
+	return unix.Read(fd, buf)
+}
+
+func (p *Poller) Write(fd int, buf []byte) (int, error) {
+	return unix.Write(fd, buf)
+}
+
+// 超过MaxIovecs的部分不会写，和写了一部分的情况一样由调用方处理
+func (p *Poller) Writev(fd int, bufs [][]byte) (int, error) {
+	if len(bufs) > MaxIovecs {
+		bufs = bufs[:MaxIovecs]
+	}
+	return writev(fd, bufs)
+}
+
+// 把infd从offset开始的count个字节发送到fd，出错（例如EAGAIN）时也可能已经发送了一部分，以返回的字节数为准
+func (p *Poller) SendFile(fd, infd int, offset int64, count int) (int, error) {
+	n, err := unix.Sendfile(fd, infd, &offset, count)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
 // unix.NOTE_TRIGGER 触发用户自定义事件
 var wakeChanges = []unix.Kevent_t{
 	{Ident: 0, Filter: unix.EVFILT_USER, Fflags: unix.NOTE_TRIGGER},
@@ -108,6 +182,10 @@ func (p *Poller) Trigger(job internal.Job) error {
 }
 
 func (p *Poller) Polling(callback func(fd int, filter int16) error) (err error) {
+	// 上次Polling因为任务出错返回时，剩下的任务还在队列里，不会再有唤醒事件
+	if err = p.asyncJobQueue.ForEach(); err != nil {
+		return
+	}
 	el := newEventList(InitEvents)
 	var wakenUp bool
 	for {
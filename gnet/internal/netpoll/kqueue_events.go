@@ -1,3 +1,6 @@
+//go:build freebsd || dragonfly || darwin
+// +build freebsd dragonfly darwin
+
 package netpoll
 
 import (
@@ -6,6 +9,7 @@ import (
 
 const (
 	InitEvents    = 64
+	MaxIovecs     = 1024
 	EVFilterWrite = unix.EVFILT_WRITE
 	EVFilterRead  = unix.EVFILT_READ
 	// 除了read、write外的事件
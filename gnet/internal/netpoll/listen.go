@@ -0,0 +1,86 @@
+package netpoll
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// 把监听的地址转换成创建socket的domain和bind使用的Sockaddr，协议族的选择和net.Listen一致：
+// tcp、udp监听通配地址（包括0.0.0.0）时使用同时接收IPv4的IPv6 socket，其他IPv4地址使用IPv4 socket，
+// tcp6、udp6只接收IPv6。unix的地址以@开头时是linux的抽象命名空间，不对应文件
+func ListenSockaddr(network, addr string) (domain int, sa unix.Sockaddr, ipv6only bool, err error) {
+	var (
+		ip   net.IP
+		port int
+		zone string
+	)
+	switch network {
+	case "unix":
+		return unix.AF_UNIX, &unix.SockaddrUnix{Name: addr}, false, nil
+	case "tcp", "tcp4", "tcp6":
+		var tcpAddr *net.TCPAddr
+		if tcpAddr, err = net.ResolveTCPAddr(network, addr); err != nil {
+			return
+		}
+		ip, port, zone = tcpAddr.IP, tcpAddr.Port, tcpAddr.Zone
+	case "udp", "udp4", "udp6":
+		var udpAddr *net.UDPAddr
+		if udpAddr, err = net.ResolveUDPAddr(network, addr); err != nil {
+			return
+		}
+		ip, port, zone = udpAddr.IP, udpAddr.Port, udpAddr.Zone
+	default:
+		return 0, nil, false, unix.EAFNOSUPPORT
+	}
+
+	wildcard := ip == nil || ip.IsUnspecified()
+	if strings.HasSuffix(network, "4") || ip.To4() != nil && !wildcard && !strings.HasSuffix(network, "6") {
+		sa4 := &unix.SockaddrInet4{Port: port}
+		if ip != nil {
+			copy(sa4.Addr[:], ip.To4())
+		}
+		return unix.AF_INET, sa4, false, nil
+	}
+	sa6 := &unix.SockaddrInet6{Port: port}
+	if ip != nil && !(wildcard && ip.To4() != nil) {
+		copy(sa6.Addr[:], ip.To16())
+	}
+	if zone != "" {
+		ifi, err := net.InterfaceByName(zone)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		sa6.ZoneId = uint32(ifi.Index)
+	}
+	return unix.AF_INET6, sa6, strings.HasSuffix(network, "6"), nil
+}
+
+// 创建close-on-exec、非阻塞的socket
+func Socket(domain, typ int) (int, error) {
+	fd, err := unix.Socket(domain, typ, 0)
+	if err != nil {
+		return -1, err
+	}
+	unix.CloseOnExec(fd)
+	if err = unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// 多个socket bind同一个地址，由内核在它们之间分配连接或者数据报，必须在bind之前设置
+func SetReusePort(fd int) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
+
+// only为false时IPv6 socket同时接收IPv4（映射为::ffff:a.b.c.d），必须在bind之前设置
+func SetIPv6Only(fd int, only bool) error {
+	v := 0
+	if only {
+		v = 1
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, v)
+}
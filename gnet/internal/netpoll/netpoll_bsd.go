@@ -0,0 +1,57 @@
+//go:build freebsd || dragonfly
+// +build freebsd dragonfly
+
+package netpoll
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func SetKeepAlive(fd, secs int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
+		return err
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, secs); err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, secs)
+}
+
+// IP_SENDSRCADDR和IP_RECVDSTADDR的值相同，dragonfly的golang.org/x/sys/unix没有定义前者
+const (
+	ipRecvDstAddr   = unix.IP_RECVDSTADDR
+	ipv6RecvPktInfo = unix.IPV6_RECVPKTINFO
+	ipv6PktInfo     = unix.IPV6_PKTINFO
+)
+
+func parseIPv4PktInfo(typ int, data []byte) (net.IP, int, bool) {
+	if typ != unix.IP_RECVDSTADDR || len(data) < net.IPv4len {
+		return nil, 0, false
+	}
+	return append(net.IP(nil), data[:net.IPv4len]...), 0, true
+}
+
+func ipv4PktInfo(ip net.IP) (int, []byte) {
+	return unix.IP_RECVDSTADDR, ip
+}
+
+// 没有TCP_QUICKACK
+func SetQuickAck(fd int) error {
+	return nil
+}
+
+// dragonfly不支持TCP Fast Open，暂时都不设置
+func SetFastOpen(fd, qlen int) error {
+	return nil
+}
+
+// listen的backlog默认使用系统允许的最大值
+func MaxListenerBacklog() int {
+	n, err := unix.SysctlUint32("kern.ipc.somaxconn")
+	if err != nil || n == 0 {
+		return unix.SOMAXCONN
+	}
+	return int(n)
+}
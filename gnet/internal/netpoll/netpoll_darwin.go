@@ -1,17 +1,62 @@
 package netpoll
 
 import (
+	"net"
+	"unsafe"
+
 	"golang.org/x/sys/unix"
 )
 
 func SetKeepAlive(fd, secs int) error {
-	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, 0x8, 1); err != nil {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
 		return err
 	}
-	switch err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, 0x101, secs); err {
+	// 10.8之前的系统没有TCP_KEEPINTVL
+	switch err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, secs); err {
 	case nil, unix.ENOPROTOOPT:
 	default:
 		return err
 	}
 	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPALIVE, secs)
 }
+
+// golang.org/x/sys/unix没有定义darwin的IPV6_RECVPKTINFO、IPV6_PKTINFO，取自netinet6/in6.h
+const (
+	ipRecvDstAddr   = unix.IP_PKTINFO
+	ipv6RecvPktInfo = 0x3d
+	ipv6PktInfo     = 0x2e
+)
+
+func parseIPv4PktInfo(typ int, data []byte) (net.IP, int, bool) {
+	if typ != unix.IP_PKTINFO || len(data) < unix.SizeofInet4Pktinfo {
+		return nil, 0, false
+	}
+	pi := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+	return append(net.IP(nil), pi.Addr[:]...), int(pi.Ifindex), true
+}
+
+// 只指定源地址，出口网卡仍然由路由决定
+func ipv4PktInfo(ip net.IP) (int, []byte) {
+	var pi unix.Inet4Pktinfo
+	copy(pi.Spec_dst[:], ip)
+	return unix.IP_PKTINFO, (*[unix.SizeofInet4Pktinfo]byte)(unsafe.Pointer(&pi))[:]
+}
+
+// darwin没有TCP_QUICKACK
+func SetQuickAck(fd int) error {
+	return nil
+}
+
+// darwin上TCP_FASTOPEN只是开关，队列长度由系统决定
+func SetFastOpen(fd, qlen int) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, 1)
+}
+
+// listen的backlog默认使用系统允许的最大值
+func MaxListenerBacklog() int {
+	n, err := unix.SysctlUint32("kern.ipc.somaxconn")
+	if err != nil || n == 0 {
+		return unix.SOMAXCONN
+	}
+	return int(n)
+}
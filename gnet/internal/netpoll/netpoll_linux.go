@@ -0,0 +1,71 @@
+package netpoll
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func SetKeepAlive(fd, secs int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
+		return err
+	}
+	// 探测包的发送间隔
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, secs); err != nil {
+		return err
+	}
+	// 连接空闲多久后开始发送探测包
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, secs)
+}
+
+const (
+	ipRecvDstAddr   = unix.IP_PKTINFO
+	ipv6RecvPktInfo = unix.IPV6_RECVPKTINFO
+	ipv6PktInfo     = unix.IPV6_PKTINFO
+)
+
+func parseIPv4PktInfo(typ int, data []byte) (net.IP, int, bool) {
+	if typ != unix.IP_PKTINFO || len(data) < unix.SizeofInet4Pktinfo {
+		return nil, 0, false
+	}
+	pi := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+	return append(net.IP(nil), pi.Addr[:]...), int(pi.Ifindex), true
+}
+
+// 只指定源地址，出口网卡仍然由路由决定
+func ipv4PktInfo(ip net.IP) (int, []byte) {
+	var pi unix.Inet4Pktinfo
+	copy(pi.Spec_dst[:], ip)
+	return unix.IP_PKTINFO, (*[unix.SizeofInet4Pktinfo]byte)(unsafe.Pointer(&pi))[:]
+}
+
+// 立即发送ACK，TCP_QUICKACK不是永久的，内核之后可能又回到延迟ACK
+func SetQuickAck(fd int) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_QUICKACK, 1)
+}
+
+// 在监听socket上开启TCP Fast Open，qlen是还没完成三次握手的TFO请求的队列长度
+func SetFastOpen(fd, qlen int) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, qlen)
+}
+
+// listen的backlog默认使用系统允许的最大值，和net.Listen一样读取/proc/sys/net/core/somaxconn
+func MaxListenerBacklog() int {
+	b, err := ioutil.ReadFile("/proc/sys/net/core/somaxconn")
+	if err != nil {
+		return unix.SOMAXCONN
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || n <= 0 {
+		return unix.SOMAXCONN
+	}
+	// 4.1之前的内核backlog是uint16
+	if n > 1<<16-1 {
+		n = 1<<16 - 1
+	}
+	return n
+}
@@ -0,0 +1,102 @@
+package netpoll
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// PktInfo是UDP数据报的目的地址，回复时作为源地址，多网卡或者监听0.0.0.0时回复才能从收到数据报的地址发出
+type PktInfo struct {
+	// 数据报的目的地址，nil表示没有拿到
+	IP net.IP
+	// 收到数据报的网卡
+	Ifindex int
+	// 来自IPV6_PKTINFO，回复时也要用IPV6_PKTINFO，双栈socket上的IPv4地址是IPv4-mapped的形式
+	ipv6 bool
+}
+
+// UDPAddr把目的地址和listener的端口组合成本地地址
+func (info *PktInfo) UDPAddr(port int) *net.UDPAddr {
+	addr := &net.UDPAddr{IP: info.IP, Port: port}
+	if info.ipv6 && info.IP.IsLinkLocalUnicast() {
+		addr.Zone = ip6ZoneToString(info.Ifindex)
+	}
+	return addr
+}
+
+// OOBSize是RecvMsg的oob至少需要的大小，双栈socket上可能同时收到IPv4和IPv6的两条，IPv4的不会比IPv6的大
+var OOBSize = 2 * unix.CmsgSpace(unix.SizeofInet6Pktinfo)
+
+// EnableRecvPktInfo让UDP socket收到数据报时带上目的地址，见RecvMsg
+func EnableRecvPktInfo(fd int) error {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return err
+	}
+	switch sa.(type) {
+	case *unix.SockaddrInet4:
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IP, ipRecvDstAddr, 1)
+	case *unix.SockaddrInet6:
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, ipv6RecvPktInfo, 1)
+	}
+	return unix.EAFNOSUPPORT
+}
+
+// RecvMsg和Recvfrom一样读一个数据报，同时从oob中取出目的地址
+func RecvMsg(fd int, buf, oob []byte) (n int, sa unix.Sockaddr, info PktInfo, err error) {
+	var oobn int
+	if n, oobn, _, sa, err = unix.Recvmsg(fd, buf, oob, 0); err != nil || oobn == 0 {
+		return
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		// 只是拿不到目的地址，数据报本身是完整的
+		return n, sa, info, nil
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.IPPROTO_IPV6 && int(m.Header.Type) == ipv6PktInfo &&
+			len(m.Data) >= unix.SizeofInet6Pktinfo:
+			pi := (*unix.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			info.IP = append(net.IP(nil), pi.Addr[:]...)
+			info.Ifindex = int(pi.Ifindex)
+			info.ipv6 = true
+		case m.Header.Level == unix.IPPROTO_IP:
+			if ip, ifindex, ok := parseIPv4PktInfo(int(m.Header.Type), m.Data); ok {
+				info.IP, info.Ifindex = ip, ifindex
+			}
+		}
+	}
+	return n, sa, info, nil
+}
+
+// SendMsg把数据报发给sa，源地址是info中的目的地址，没有时和Sendto一样由系统选择
+func SendMsg(fd int, buf []byte, sa unix.Sockaddr, info *PktInfo) error {
+	if info == nil || info.IP == nil {
+		return unix.Sendto(fd, buf, 0, sa)
+	}
+	var oob []byte
+	if info.ipv6 {
+		pi := unix.Inet6Pktinfo{Ifindex: uint32(info.Ifindex)}
+		copy(pi.Addr[:], info.IP.To16())
+		oob = appendCmsg(oob, unix.IPPROTO_IPV6, ipv6PktInfo,
+			(*[unix.SizeofInet6Pktinfo]byte)(unsafe.Pointer(&pi))[:])
+	} else {
+		typ, data := ipv4PktInfo(info.IP.To4())
+		oob = appendCmsg(oob, unix.IPPROTO_IP, typ, data)
+	}
+	return unix.Sendmsg(fd, buf, oob, sa, 0)
+}
+
+func appendCmsg(oob []byte, level, typ int, data []byte) []byte {
+	off := len(oob)
+	oob = append(oob, make([]byte, unix.CmsgSpace(len(data)))...)
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[off]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(unix.CmsgLen(len(data)))
+	copy(oob[off+unix.CmsgLen(0):], data)
+	return oob
+}
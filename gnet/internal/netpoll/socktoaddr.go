@@ -20,6 +20,31 @@ func SockaddrToTCPOrUnixAddr(sa unix.Sockaddr) net.Addr {
 	return nil
 }
 
+// 把net.TCPAddr、net.UnixAddr转换成connect使用的Sockaddr，同时返回创建socket时的domain
+func TCPOrUnixAddrToSockaddr(addr net.Addr) (int, unix.Sockaddr, error) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			sa := &unix.SockaddrInet4{Port: addr.Port}
+			copy(sa.Addr[:], ip4)
+			return unix.AF_INET, sa, nil
+		}
+		sa := &unix.SockaddrInet6{Port: addr.Port}
+		copy(sa.Addr[:], addr.IP.To16())
+		if addr.Zone != "" {
+			ifi, err := net.InterfaceByName(addr.Zone)
+			if err != nil {
+				return 0, nil, err
+			}
+			sa.ZoneId = uint32(ifi.Index)
+		}
+		return unix.AF_INET6, sa, nil
+	case *net.UnixAddr:
+		return unix.AF_UNIX, &unix.SockaddrUnix{Name: addr.Name}, nil
+	}
+	return 0, nil, unix.EAFNOSUPPORT
+}
+
 func SockaddrToUDPAddr(sa unix.Sockaddr) *net.UDPAddr {
 	switch sa := sa.(type) {
 	case *unix.SockaddrInet4:
@@ -50,7 +75,7 @@ func ip6ZoneToString(zone int) string {
 	if zone == 0 {
 		return ""
 	}
-	if ifi, err := net.InterfaceByIndex(zone); err != nil {
+	if ifi, err := net.InterfaceByIndex(zone); err == nil {
 		return ifi.Name
 	}
 	return int2decimal(uint(zone))
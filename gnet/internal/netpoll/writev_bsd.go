@@ -0,0 +1,31 @@
+//go:build freebsd || dragonfly || darwin
+// +build freebsd dragonfly darwin
+
+package netpoll
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// 这个版本的x/sys/unix在bsd上没有提供Writev
+func writev(fd int, bufs [][]byte) (int, error) {
+	iovecs := make([]unix.Iovec, 0, len(bufs))
+	for _, buf := range bufs {
+		if len(buf) == 0 {
+			continue
+		}
+		iov := unix.Iovec{Base: &buf[0]}
+		iov.SetLen(len(buf))
+		iovecs = append(iovecs, iov)
+	}
+	if len(iovecs) == 0 {
+		return 0, nil
+	}
+	n, _, errno := unix.Syscall(unix.SYS_WRITEV, uintptr(fd), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
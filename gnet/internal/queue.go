@@ -26,6 +26,10 @@ func (q *AsyncJobQueue) ForEach() (err error) {
 	q.lock.Unlock()
 	for i := range jobs {
 		if err = jobs[i](); err != nil {
+			// 剩下的任务放回队列头部，eventloop重启后按原来的顺序继续执行
+			q.lock.Lock()
+			q.jobs = append(jobs[i+1:], q.jobs...)
+			q.lock.Unlock()
 			return err
 		}
 	}
@@ -1,63 +1,144 @@
 package gnet
 
 import (
-	"golang.org/x/sys/unix"
 	"net"
 	"os"
+	"strings"
 	"sync"
+
+	"golang.org/x/sys/unix"
+	"golang_project_note/gnet/internal/netpoll"
 )
 
 type listener struct {
 	once sync.Once
-	// 文件描述符
-	f  *os.File
+	// 文件描述符，由listener自己创建，只有它一个所有者
 	fd int
-	// TCP
-	ln net.Listener
-	// UDP
-	pconn net.PacketConn
+	// UDP没有accept，各eventloop直接读fd
+	udp bool
 	// 地址的抽象接口
 	lnaddr net.Addr
 	// network: tcp
 	// addr: 127.0.0.1
 	addr, network string
+	// Start的addr或者ListenerConfig.Addr，用于Stop查找server
+	protoAddr string
+	// 不为nil时这个listener accept的连接使用它，而不是Options.Codec
+	codec ICodec
+	// Options.SocketOptions或者ListenerConfig.SocketOptions
+	sockopts *SocketOptions
 }
 
-// 1. 获取描述符
-// 2. 设置非阻塞fd
-func (ln *listener) renormalize() error {
-	var err error
-	switch netln := ln.ln.(type) {
-	case nil:
-		switch pconn := ln.pconn.(type) {
-		case *net.UDPConn:
-			ln.f, err = pconn.File()
-		}
-	case *net.TCPListener:
-		ln.f, err = netln.File()
-	case *net.UnixListener:
-		ln.f, err = netln.File()
+// 直接创建监听的socket，不经过net.Listen：
+// 1. 按地址选择协议族，创建非阻塞的socket
+// 2. bind之前设置SO_REUSEADDR、SO_REUSEPORT、IPV6_V6ONLY和SocketOptions
+// 3. bind，TCP、unix再listen并开启TCP Fast Open，UDP开启IP_PKTINFO/IPV6_RECVPKTINFO
+// 4. 用getsockname得到实际监听的地址（端口为0时由系统分配）
+func (ln *listener) listen(reusePort bool) (err error) {
+	typ := unix.SOCK_STREAM
+	switch ln.network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	case "udp", "udp4", "udp6":
+		typ, ln.udp = unix.SOCK_DGRAM, true
+	default:
+		return ErrUnsupportedProtocol
 	}
+	domain, sa, ipv6only, err := netpoll.ListenSockaddr(ln.network, ln.addr)
 	if err != nil {
-		ln.close()
 		return err
 	}
-	ln.fd = int(ln.f.Fd())
-	return unix.SetNonblock(ln.fd, true)
+	if ln.fd, err = netpoll.Socket(domain, typ); err != nil {
+		sa6, ok := sa.(*unix.SockaddrInet6)
+		if err != unix.EAFNOSUPPORT || !ok || ipv6only || sa6.Addr != [16]byte{} {
+			return os.NewSyscallError("socket", err)
+		}
+		// 系统不支持IPv6时通配地址退回到IPv4
+		domain, sa = unix.AF_INET, &unix.SockaddrInet4{Port: sa6.Port}
+		if ln.fd, err = netpoll.Socket(domain, typ); err != nil {
+			return os.NewSyscallError("socket", err)
+		}
+	}
+	defer func() {
+		if err != nil {
+			ln.close()
+		}
+	}()
+
+	if domain == unix.AF_INET6 {
+		if err = netpoll.SetIPv6Only(ln.fd, ipv6only); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	// 和net.Listen一样，TCP的监听socket总是设置SO_REUSEADDR，重启时不会因为TIME_WAIT的连接bind失败
+	if ln.sockopts.ReuseAddr || typ == unix.SOCK_STREAM && domain != unix.AF_UNIX {
+		if err = netpoll.SetReuseAddr(ln.fd); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	// linux上unix域socket不支持SO_REUSEPORT，各eventloop直接共享同一个fd即可
+	if reusePort && domain != unix.AF_UNIX {
+		if err = netpoll.SetReusePort(ln.fd); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err = ln.sockopts.setListener(ln.fd); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+
+	if domain == unix.AF_UNIX && !ln.abstract() {
+		sniffErrorAndLog(os.RemoveAll(ln.addr))
+	}
+	if err = unix.Bind(ln.fd, sa); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	if ln.udp {
+		// 拿不到目的地址时本地地址退回到监听的地址，回复由系统选择源地址
+		if err := netpoll.EnableRecvPktInfo(ln.fd); err != nil {
+			sniffErrorAndLog(err)
+		}
+	} else {
+		backlog := ln.sockopts.ListenBacklog
+		if backlog <= 0 {
+			backlog = netpoll.MaxListenerBacklog()
+		}
+		if err = unix.Listen(ln.fd, backlog); err != nil {
+			return os.NewSyscallError("listen", err)
+		}
+		if ln.sockopts.TCPFastOpen > 0 && domain != unix.AF_UNIX {
+			if err = netpoll.SetFastOpen(ln.fd, ln.sockopts.TCPFastOpen); err != nil {
+				return os.NewSyscallError("setsockopt", err)
+			}
+		}
+	}
+
+	local, err := unix.Getsockname(ln.fd)
+	if err != nil {
+		return os.NewSyscallError("getsockname", err)
+	}
+	if ln.udp {
+		ln.lnaddr = netpoll.SockaddrToUDPAddr(local)
+	} else {
+		ln.lnaddr = netpoll.SockaddrToTCPOrUnixAddr(local)
+	}
+	return nil
+}
+
+// linux抽象命名空间的unix地址，没有对应的文件
+func (ln *listener) abstract() bool {
+	return ln.network == "unix" && strings.HasPrefix(ln.addr, "@")
 }
 
 func (ln *listener) close() {
 	ln.once.Do(func() {
-		if ln.f != nil {
-			sniffErrorAndLog(ln.f.Close())
-		}
-		if ln.ln != nil {
-			sniffErrorAndLog(ln.ln.Close())
-		}
-		if ln.pconn != nil {
-			sniffErrorAndLog(ln.pconn.Close())
+		if ln.fd > 0 {
+			// linux上shutdown让socket立即停止监听，新的连接会被拒绝，
+			// 即使io_uring中进行的accept还持有它，close之后它也不会被真正关闭
+			if !ln.udp {
+				_ = unix.Shutdown(ln.fd, unix.SHUT_RD)
+			}
+			sniffErrorAndLog(os.NewSyscallError("close", unix.Close(ln.fd)))
 		}
-		if ln.network == "unix" {
+		if ln.network == "unix" && !ln.abstract() {
 			sniffErrorAndLog(os.RemoveAll(ln.addr))
 		}
 	})
@@ -23,8 +23,10 @@ type (
 		calibrate(*eventloop, int32)
 	}
 
+	// next会在accept的main reactor和调用Dial、Register的goroutine中同时调用
 	roundRobinEventLoopSet struct {
-		nextLoopIndex int
+		// 已经分配过的次数
+		nextLoopIndex uint32
 		size          int
 		eventLoops    []*eventloop
 	}
@@ -55,12 +57,9 @@ func (set *roundRobinEventLoopSet) register(el *eventloop) {
 	set.size++
 }
 
-func (set *roundRobinEventLoopSet) next(_ int) (el *eventloop) {
-	el = set.eventLoops[set.nextLoopIndex]
-	if set.nextLoopIndex++; set.nextLoopIndex >= set.size {
-		set.nextLoopIndex = 0
-	}
-	return
+func (set *roundRobinEventLoopSet) next(_ int) *eventloop {
+	i := atomic.AddUint32(&set.nextLoopIndex, 1) - 1
+	return set.eventLoops[int(i%uint32(set.size))]
 }
 
 func (set *roundRobinEventLoopSet) iterate(f func(int, *eventloop) bool) {
@@ -127,12 +126,18 @@ func (set *leastConnectionsEventLoopSet) next(i int) *eventloop {
 	// 每 calibrateConnsThreshold 次会重建最小堆，这样能减少锁的使用
 	if atomic.LoadInt32(&set.threshold) >= set.calibrateConnsThreshold {
 		set.Lock()
-		heap.Init(&set.minHeap)
-		set.cachedRoot = set.minHeap[0]
-		atomic.StoreInt32(&set.threshold, 0)
+		// 可能已经被同时调用的next重建过了
+		if set.threshold >= set.calibrateConnsThreshold {
+			heap.Init(&set.minHeap)
+			set.cachedRoot = set.minHeap[0]
+			atomic.StoreInt32(&set.threshold, 0)
+		}
 		set.Unlock()
 	}
-	return set.cachedRoot
+	set.RLock()
+	el := set.cachedRoot
+	set.RUnlock()
+	return el
 }
 
 func (set *leastConnectionsEventLoopSet) iterate(f func(int, *eventloop) bool) {
@@ -1,3 +1,6 @@
+//go:build freebsd || dragonfly || darwin
+// +build freebsd dragonfly darwin
+
 package gnet
 
 import (
@@ -6,21 +9,49 @@ import (
 
 func (el *eventloop) handleEvent(fd int, filter int16) error {
 	if c, ok := el.connections[fd]; ok {
-		if filter == netpoll.EVFilterSock {
-			return el.loopCloseConn(c, nil)
+		return el.handleConnEvent(c, filter)
+	}
+	return el.loopAccept(fd)
+}
+
+func (el *eventloop) handleConnEvent(c *conn, filter int16) error {
+	if filter == netpoll.EVFilterSock {
+		return el.loopCloseConn(c, nil)
+	}
+	if c.connecting {
+		return el.loopConnect(c)
+	}
+	if el.svr.opts.EdgeTriggered {
+		return el.handleConnEventET(c, filter)
+	}
+	switch c.pendingOutput() {
+	case true:
+		// 可写事件发生，又有需要写的数据，则直接write
+		if filter == netpoll.EVFilterWrite {
+			return el.loopWrite(c)
 		}
-		switch c.outboundBuffer.IsEmpty() {
-		case false:
-			if filter == netpoll.EVFilterWrite {
-				return el.loopWrite(c)
-			}
-			return nil
-		case true:
-			if filter == netpoll.EVFilterRead {
-				return el.loopRead(c)
-			}
-			return nil
+		return nil
+	case false:
+		// 暂停读之前已经取出的可读事件
+		if filter == netpoll.EVFilterRead && !c.readingPaused() {
+			return el.loopRead(c)
 		}
+		return nil
 	}
-	return el.loopAccept(fd)
+	return nil
+}
+
+// 边缘触发下同一个状态只会通知一次，不管outboundBuffer是否为空，可读事件都必须处理
+func (el *eventloop) handleConnEventET(c *conn, filter int16) error {
+	switch filter {
+	case netpoll.EVFilterWrite:
+		if c.pendingOutput() {
+			return el.loopWrite(c)
+		}
+	case netpoll.EVFilterRead:
+		if !c.readingPaused() {
+			return el.loopRead(c)
+		}
+	}
+	return nil
 }
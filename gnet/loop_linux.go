@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package gnet
+
+import (
+	"golang_project_note/gnet/internal/netpoll"
+)
+
+func (el *eventloop) handleEvent(fd int, ev uint32) error {
+	if c, ok := el.connections[fd]; ok {
+		return el.handleConnEvent(c, ev)
+	}
+	return el.loopAccept(fd)
+}
+
+func (el *eventloop) handleConnEvent(c *conn, ev uint32) error {
+	if c.connecting {
+		return el.loopConnect(c)
+	}
+	if el.svr.opts.EdgeTriggered {
+		return el.handleConnEventET(c, ev)
+	}
+	// 出错或对端关闭的情况，交给read/write返回的错误去关闭连接
+	switch c.pendingOutput() {
+	case true:
+		// 可写事件发生，又有需要写的数据，则直接write
+		if ev&netpoll.OutEvents != 0 {
+			return el.loopWrite(c)
+		}
+		return nil
+	case false:
+		if el.readable(c, ev) {
+			return el.loopRead(c)
+		}
+		return nil
+	}
+	return nil
+}
+
+// 暂停读时不再监听可读事件，但出错、挂断总会通知，这时仍然要读，由read返回的错误关闭连接
+func (el *eventloop) readable(c *conn, ev uint32) bool {
+	return ev&netpoll.InEvents != 0 && (!c.readingPaused() || ev&netpoll.ErrEvents != 0)
+}
+
+// 边缘触发下同一个状态只会通知一次，可写、可读都要处理，不能像水平触发那样二选一
+func (el *eventloop) handleConnEventET(c *conn, ev uint32) error {
+	if ev&netpoll.OutEvents != 0 && c.pendingOutput() {
+		if err := el.loopWrite(c); err != nil || !c.opened {
+			return err
+		}
+	}
+	if el.readable(c, ev) {
+		return el.loopRead(c)
+	}
+	return nil
+}
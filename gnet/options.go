@@ -1,11 +1,34 @@
 package gnet
 
 import (
+	"crypto/tls"
 	"time"
 )
 
 type Option func(opts *Options)
 
+// eventloop因为错误（不是Shutdown）退出时的处理方式
+type LoopFailurePolicy int
+
+const (
+	// 关闭整个server，默认行为
+	ShutdownOnLoopFailure LoopFailurePolicy = iota
+	// 保留该eventloop上的连接，重新开始polling
+	RestartLoopOnFailure
+)
+
+// AsyncReact提交到pool失败（pool已满，goroutine.ErrPoolOverload）时的处理方式
+type ReactOverloadPolicy int
+
+const (
+	// 丢弃这一帧，默认行为
+	RejectFrameOnOverload ReactOverloadPolicy = iota
+	// 关闭连接，OnClosed收到goroutine.ErrPoolOverload
+	CloseConnOnOverload
+	// 暂停读这个连接，稍后重新提交这一帧
+	BackpressureOnOverload
+)
+
 func loadOptions(options ...Option) *Options {
 	opts := new(Options)
 	for _, option := range options {
@@ -23,6 +46,84 @@ type Options struct {
 	TCPKeepAlive time.Duration
 	Ticker       bool
 	Codec        ICodec
+	// 是否使用边缘触发（epoll: EPOLLET，kqueue: EV_CLEAR）
+	EdgeTriggered bool
+	// 实验性：使用io_uring提交accept/recv/send（仅linux 5.7+），不支持时自动退回epoll，
+	// 开启后EdgeTriggered不再生效
+	IOUring bool
+	// 不监听SIGINT/SIGTERM，由调用方自己决定何时Stop
+	DisableSignalNotify bool
+	// 某个eventloop出错退出时是重启这个eventloop还是关闭整个server
+	LoopFailurePolicy LoopFailurePolicy
+	// 连接上没有任何读写超过这个时间就关闭，OnClosed收到ErrIdleTimeout
+	IdleTimeout time.Duration
+	// 超过这个时间没有读到数据就关闭，OnClosed收到ErrReadTimeout
+	ReadTimeout time.Duration
+	// outboundBuffer中有数据时，超过这个时间没有写出任何数据就关闭，OnClosed收到ErrWriteTimeout
+	WriteTimeout time.Duration
+	// outboundBuffer超过高水位时暂停读这个连接，并调用BackpressureHandler.OnBackpressure，0表示不启用
+	OutboundHighWatermark int
+	// 暂停后outboundBuffer降到低水位及以下时恢复读，并调用BackpressureHandler.OnWritable，大于高水位时按高水位处理
+	OutboundLowWatermark int
+	// outboundBuffer加上AsyncWrite、AsyncWritev还没执行的数据超过这个大小时，AsyncWrite、AsyncWritev
+	// 返回ErrOutboundBufferFull，0表示不限制
+	MaxOutboundBuffer int
+	// 收到、还没有被codec解码成帧的数据超过这个大小时关闭连接，OnClosed收到*FrameTooLargeError，0表示不限制。
+	// 对所有codec都有效，防止对端一直不发送完整的帧
+	MaxInboundBuffer int
+	// 在goroutine pool中调用React，返回的数据回到所属的eventloop中按帧的顺序写出。
+	// React中只能调用Conn的AsyncWrite、Wake、Close等可以在其他goroutine中调用的方法；
+	// Wake触发的React和UDP的React仍然在eventloop中调用。
+	// server停止时（包括ctx结束后的强制关闭）会等所有还在执行的React返回
+	AsyncReact bool
+	// AsyncReact使用的pool的大小，0表示goroutine.DefaultAntsPoolSize
+	ReactPoolSize int
+	// AsyncReact时每个连接同时在执行的React的上限，达到后暂停读这个连接，0表示1（同一个连接的帧依次处理）
+	MaxConnReacts int
+	// AsyncReact时pool已满的处理方式
+	ReactOverloadPolicy ReactOverloadPolicy
+	// 不为nil时accept的连接作为TLS服务端（NewClient时Dial的连接作为TLS客户端）在eventloop中握手、加解密，
+	// 握手完成后才调用OnOpened，React、ICodec看到的都是明文。TLS连接的SendFile不是零拷贝。
+	// 和Dial的连接connect失败一样，握手失败或者超时的连接不会调用OnOpened，只调用OnClosed并传入握手的错误，
+	// 这时TLSConnectionState返回nil
+	TLSConfig *tls.Config
+	// 除了Start的addr之外还要监听的地址
+	Listeners []ListenerConfig
+	// 监听socket和accept的连接上的socket选项，NewClient时用于Dial的连接
+	SocketOptions
+}
+
+// SocketOptions中的零值表示不修改，使用系统的默认值。不支持的平台上相应的选项会被忽略
+type SocketOptions struct {
+	// 连接上的TCP_NODELAY
+	TCPNoDelay bool
+	// 监听socket和连接上的SO_RCVBUF、SO_SNDBUF
+	SocketRecvBuffer int
+	SocketSendBuffer int
+	// 连接上的SO_LINGER，只支持小于0：close直接丢弃剩余的数据并发送RST。
+	// 大于0时close会阻塞到数据发完或者超时，连接在event-loop中关闭，会卡住整个loop，
+	// 所以Start、NewClient返回ErrUnsupportedLinger
+	SocketLinger int
+	// 连接打开时设置一次TCP_QUICKACK（仅linux），内核之后可能又回到延迟ACK
+	TCPQuickAck bool
+	// 监听socket上TCP Fast Open的队列长度（linux、darwin）
+	TCPFastOpen int
+	// listen的backlog，0表示系统的somaxconn
+	ListenBacklog int
+	// 监听socket和连接上的IP_TOS，IPv6时是IPV6_TCLASS
+	IPTOS int
+	// bind之前设置SO_REUSEADDR，和ReusePort无关；TCP的监听socket总是会设置
+	ReuseAddr bool
+}
+
+// ListenerConfig是Start额外监听的一个地址，格式和Start的addr相同，例如tcp6://[::1]:8080、unix:///run/app.sock，
+// linux上unix://@name是抽象命名空间的unix socket
+type ListenerConfig struct {
+	Addr string
+	// 这个地址accept的连接使用的codec，nil表示使用Options.Codec
+	Codec ICodec
+	// 不为nil时代替Options.SocketOptions用于这个地址
+	SocketOptions *SocketOptions
 }
 
 func WithOptions(options Options) Option {
@@ -78,3 +179,165 @@ func WithCodec(codec ICodec) Option {
 		opts.Codec = codec
 	}
 }
+
+func WithEdgeTriggered(edgeTriggered bool) Option {
+	return func(opts *Options) {
+		opts.EdgeTriggered = edgeTriggered
+	}
+}
+
+func WithIOUring(ioUring bool) Option {
+	return func(opts *Options) {
+		opts.IOUring = ioUring
+	}
+}
+
+func WithDisableSignalNotify(disable bool) Option {
+	return func(opts *Options) {
+		opts.DisableSignalNotify = disable
+	}
+}
+
+func WithLoopFailurePolicy(policy LoopFailurePolicy) Option {
+	return func(opts *Options) {
+		opts.LoopFailurePolicy = policy
+	}
+}
+
+func WithIdleTimeout(idleTimeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.IdleTimeout = idleTimeout
+	}
+}
+
+func WithReadTimeout(readTimeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.ReadTimeout = readTimeout
+	}
+}
+
+func WithWriteTimeout(writeTimeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.WriteTimeout = writeTimeout
+	}
+}
+
+func WithOutboundHighWatermark(outboundHighWatermark int) Option {
+	return func(opts *Options) {
+		opts.OutboundHighWatermark = outboundHighWatermark
+	}
+}
+
+func WithOutboundLowWatermark(outboundLowWatermark int) Option {
+	return func(opts *Options) {
+		opts.OutboundLowWatermark = outboundLowWatermark
+	}
+}
+
+func WithMaxOutboundBuffer(maxOutboundBuffer int) Option {
+	return func(opts *Options) {
+		opts.MaxOutboundBuffer = maxOutboundBuffer
+	}
+}
+
+func WithMaxInboundBuffer(maxInboundBuffer int) Option {
+	return func(opts *Options) {
+		opts.MaxInboundBuffer = maxInboundBuffer
+	}
+}
+
+func WithAsyncReact(asyncReact bool) Option {
+	return func(opts *Options) {
+		opts.AsyncReact = asyncReact
+	}
+}
+
+func WithReactPoolSize(reactPoolSize int) Option {
+	return func(opts *Options) {
+		opts.ReactPoolSize = reactPoolSize
+	}
+}
+
+func WithMaxConnReacts(maxConnReacts int) Option {
+	return func(opts *Options) {
+		opts.MaxConnReacts = maxConnReacts
+	}
+}
+
+func WithReactOverloadPolicy(policy ReactOverloadPolicy) Option {
+	return func(opts *Options) {
+		opts.ReactOverloadPolicy = policy
+	}
+}
+
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(opts *Options) {
+		opts.TLSConfig = tlsConfig
+	}
+}
+
+func WithListeners(listeners ...ListenerConfig) Option {
+	return func(opts *Options) {
+		opts.Listeners = listeners
+	}
+}
+
+func WithSocketOptions(socketOptions SocketOptions) Option {
+	return func(opts *Options) {
+		opts.SocketOptions = socketOptions
+	}
+}
+
+func WithTCPNoDelay(tcpNoDelay bool) Option {
+	return func(opts *Options) {
+		opts.TCPNoDelay = tcpNoDelay
+	}
+}
+
+func WithSocketRecvBuffer(socketRecvBuffer int) Option {
+	return func(opts *Options) {
+		opts.SocketRecvBuffer = socketRecvBuffer
+	}
+}
+
+func WithSocketSendBuffer(socketSendBuffer int) Option {
+	return func(opts *Options) {
+		opts.SocketSendBuffer = socketSendBuffer
+	}
+}
+
+func WithSocketLinger(socketLinger int) Option {
+	return func(opts *Options) {
+		opts.SocketLinger = socketLinger
+	}
+}
+
+func WithTCPQuickAck(tcpQuickAck bool) Option {
+	return func(opts *Options) {
+		opts.TCPQuickAck = tcpQuickAck
+	}
+}
+
+func WithTCPFastOpen(tcpFastOpen int) Option {
+	return func(opts *Options) {
+		opts.TCPFastOpen = tcpFastOpen
+	}
+}
+
+func WithListenBacklog(listenBacklog int) Option {
+	return func(opts *Options) {
+		opts.ListenBacklog = listenBacklog
+	}
+}
+
+func WithIPTOS(ipTOS int) Option {
+	return func(opts *Options) {
+		opts.IPTOS = ipTOS
+	}
+}
+
+func WithReuseAddr(reuseAddr bool) Option {
+	return func(opts *Options) {
+		opts.ReuseAddr = reuseAddr
+	}
+}
@@ -20,11 +20,22 @@ func init() {
 
 type Pool = ants.Pool
 
+// 非阻塞的pool没有空闲worker时Submit返回的错误
+var ErrPoolOverload = ants.ErrPoolOverload
+
 func Default() *Pool {
+	defaultAntsPool, _ := NewPool(DefaultAntsPoolSize)
+	return defaultAntsPool
+}
+
+// 和Default一样是非阻塞的，size不大于0时使用DefaultAntsPoolSize
+func NewPool(size int) (*Pool, error) {
+	if size <= 0 {
+		size = DefaultAntsPoolSize
+	}
 	options := ants.Options{
 		Nonblocking: Nonblocking,
 		ExpiryDuration: ExpiryDuration,
 	}
-	defaultAntsPool, _ := ants.NewPool(DefaultAntsPoolSize, ants.WithOptions(options))
-	return defaultAntsPool
+	return ants.NewPool(size, ants.WithOptions(options))
 }
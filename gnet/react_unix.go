@@ -0,0 +1,189 @@
+package gnet
+
+import (
+	"time"
+
+	"golang_project_note/gnet/pool/bytebuffer"
+	"golang_project_note/gnet/pool/goroutine"
+)
+
+// BackpressureOnOverload时重新提交的间隔
+const reactRetryInterval = 10 * time.Millisecond
+
+// Options.AsyncReact时连接上的状态，第一次提交React时才创建，只在所属的eventloop中访问
+type asyncReact struct {
+	// 下一个提交的帧和下一个写回的帧的序号
+	seq, next uint64
+	// 已经提交、还没写回的帧，按序号%MaxConnReacts存放
+	pending []reactResult
+	// BackpressureOnOverload时等待重新提交的帧
+	retrying   bool
+	retryFrame *bytebuffer.ByteBuffer
+	retry      timer
+}
+
+type reactResult struct {
+	// 拷贝出来交给React的帧，React返回的out可能引用它，所以写出之后才回收
+	frame  *bytebuffer.ByteBuffer
+	out    []byte
+	action Action
+	done   bool
+}
+
+func (a *asyncReact) inflight() int {
+	return int(a.seq - a.next)
+}
+
+// 还有React没有执行完或者结果没有写出
+func (c *conn) reacting() bool {
+	return c.async != nil && (c.async.inflight() > 0 || c.async.retrying)
+}
+
+// 连接关闭时调用，还在执行的React的帧由loopReactDone回收
+func (c *conn) releaseAsync() {
+	a := c.async
+	if a == nil {
+		return
+	}
+	a.retry.Stop()
+	if a.retrying {
+		bytebuffer.Put(a.retryFrame)
+		a.retrying, a.retryFrame = false, nil
+	}
+	for seq := a.next; seq < a.seq; seq++ {
+		if r := &a.pending[seq%uint64(len(a.pending))]; r.done {
+			bytebuffer.Put(r.frame)
+			*r = reactResult{}
+		}
+	}
+}
+
+// 把帧拷贝一份交给pool执行React，frame在返回后就会被codec覆盖
+func (el *eventloop) submitReact(c *conn, frame []byte) error {
+	if c.async == nil {
+		limit := el.svr.opts.MaxConnReacts
+		if limit <= 0 {
+			limit = 1
+		}
+		c.async = &asyncReact{pending: make([]reactResult, limit)}
+		c.async.retry = timer{loop: el, f: func() error {
+			return el.loopRetryReact(c)
+		}}
+	}
+	buf := bytebuffer.Get()
+	_, _ = buf.Write(frame)
+	return el.dispatchReact(c, buf)
+}
+
+func (el *eventloop) dispatchReact(c *conn, buf *bytebuffer.ByteBuffer) error {
+	a := c.async
+	seq := a.seq
+	// stop()等所有React都Trigger之后才关闭poller
+	el.svr.reacts.Add(1)
+	err := el.svr.reactPool.Submit(func() {
+		var (
+			out []byte
+			// React panic时按Close处理，panic继续交给pool
+			action = Close
+		)
+		defer func() {
+			_ = el.poller.Trigger(func() error {
+				return el.loopReactDone(c, seq, out, action)
+			})
+			el.svr.reacts.Done()
+		}()
+		out, action = el.eventHandler.React(buf.B, c)
+	})
+	if err == nil {
+		// 结果要等这个函数返回后才能在eventloop中处理，所以这里记录不会有竞争
+		a.pending[seq%uint64(len(a.pending))] = reactResult{frame: buf}
+		a.seq++
+		if a.inflight() == len(a.pending) {
+			el.pauseRead(c, pausedByReact)
+		}
+		return nil
+	}
+	el.svr.reacts.Done()
+
+	if err != goroutine.ErrPoolOverload {
+		// pool已经关闭
+		bytebuffer.Put(buf)
+		return el.loopCloseConn(c, err)
+	}
+	switch el.svr.opts.ReactOverloadPolicy {
+	case CloseConnOnOverload:
+		bytebuffer.Put(buf)
+		return el.loopCloseConn(c, err)
+	case BackpressureOnOverload:
+		a.retrying, a.retryFrame = true, buf
+		el.pauseRead(c, pausedByReact)
+		el.addTimer(&a.retry, time.Now().Add(reactRetryInterval))
+	default:
+		bytebuffer.Put(buf)
+		el.svr.logger.Printf("dropped a frame of fd:%d, error:%v\n", c.fd, err)
+	}
+	return nil
+}
+
+// React执行完后回到eventloop，按帧的顺序写出已经完成的结果
+func (el *eventloop) loopReactDone(c *conn, seq uint64, out []byte, action Action) error {
+	a := c.async
+	r := &a.pending[seq%uint64(len(a.pending))]
+	if !c.opened {
+		bytebuffer.Put(r.frame)
+		*r = reactResult{}
+		return nil
+	}
+	r.out, r.action, r.done = out, action, true
+
+	for a.next < a.seq {
+		r = &a.pending[a.next%uint64(len(a.pending))]
+		if !r.done {
+			break
+		}
+		frame, out, action := r.frame, r.out, r.action
+		*r = reactResult{}
+		a.next++
+		if out != nil {
+			// out可能就是frame，写出之后才能释放
+			outFrame, err := el.encode(c, out)
+			if err != nil || !c.opened {
+				bytebuffer.Put(frame)
+				return err
+			}
+			if outFrame != nil {
+				el.eventHandler.PreWrite()
+				c.write(outFrame)
+			}
+		}
+		bytebuffer.Put(frame)
+		switch action {
+		case Close:
+			return el.loopCloseConn(c, nil)
+		case Shutdown:
+			return errServerShutdown
+		}
+		if !c.opened {
+			return nil
+		}
+	}
+	return el.loopRetryReact(c)
+}
+
+// 有空位时重新提交因为pool已满而等待的帧，没有等待的帧时恢复读
+func (el *eventloop) loopRetryReact(c *conn) error {
+	a := c.async
+	if !c.opened || a.inflight() == len(a.pending) {
+		return nil
+	}
+	if a.retrying {
+		buf := a.retryFrame
+		a.retrying, a.retryFrame = false, nil
+		a.retry.Stop()
+		if err := el.dispatchReact(c, buf); err != nil || a.retrying || a.inflight() == len(a.pending) {
+			return err
+		}
+	}
+	el.resumeRead(c, pausedByReact)
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build linux
+// +build linux
+
+package gnet
+
+func (svr *server) activateMainReactor() {
+	defer svr.signalShutdown()
+
+	svr.mainLoop.runPolling(func() error {
+		return svr.mainLoop.poller.Polling(func(fd int, ev uint32) error {
+			return svr.acceptNewConnection(fd)
+		})
+	})
+}
+
+func (svr *server) activateSubReactor(el *eventloop) {
+	defer func() {
+		el.closeAllConns()
+		if el.idx == 0 && svr.opts.Ticker {
+			close(svr.ticktock)
+		}
+		svr.signalShutdown()
+	}()
+
+	el.startTicker()
+
+	el.runPolling(func() error {
+		return el.poller.Polling(func(fd int, ev uint32) error {
+			if c, ok := el.connections[fd]; ok {
+				return el.handleConnEvent(c, ev)
+			}
+			return nil
+		})
+	})
+}
@@ -1,21 +1,24 @@
 package gnet
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"golang_project_note/gnet/internal/netpoll"
+	"golang_project_note/gnet/pool/goroutine"
 )
 
 type server struct {
-	ln              *listener
+	// 第一个是Start的addr，NewClient时为空
+	lns             []*listener
 	opts            *Options
 	once            sync.Once
-	cond            *sync.Cond
 	wg              sync.WaitGroup
 	mainLoop        *eventloop
 	logger          Logger
@@ -23,18 +26,68 @@ type server struct {
 	subEventLoopSet loadBalancer
 	ticktock        chan time.Duration
 	codec           ICodec
+	// Options.AsyncReact时执行React的pool
+	reactPool *goroutine.Pool
+	// 已经提交到reactPool、还没把结果Trigger回eventloop的React，关闭poller之前要等它们
+	reacts sync.WaitGroup
+	// 生命周期状态，见stateStarting等，只能向前推进
+	state int32
+	// signalShutdown()时关闭，可以在stop()开始等待之前关闭，不会丢失
+	shutdown chan struct{}
+	// server完全停止后关闭
+	done chan struct{}
 }
 
+// server的生命周期：starting -> running -> draining -> stopped
+const (
+	// 正在启动eventloop
+	stateStarting int32 = iota
+	// 正常处理连接
+	stateRunning
+	// 已经收到关闭请求，listener已经关闭，新连接会被拒绝，等待已有连接发送完毕
+	stateDraining
+	// 所有eventloop都已退出
+	stateStopped
+)
+
+// 传给Serve的地址 -> *server，供Stop()查找
+var allServers sync.Map
+
+// Stop()检查outboundBuffer是否发送完毕的间隔
+const drainCheckInterval = 10 * time.Millisecond
+
 func (svr *server) start(numEventLoop int) error {
-	if svr.opts.ReusePort || svr.ln.pconn != nil {
+	// NewClient没有监听的socket，也不需要main reactor；UDP没有accept，由各个eventloop直接读
+	if svr.opts.ReusePort || len(svr.lns) == 0 {
 		return svr.activateLoops(numEventLoop)
 	}
+	for _, ln := range svr.lns {
+		if ln.udp {
+			return svr.activateLoops(numEventLoop)
+		}
+	}
 	return svr.activateReactors(numEventLoop)
 }
 
+// fd对应的listener，不是listener时返回nil
+func (svr *server) listener(fd int) *listener {
+	for _, ln := range svr.lns {
+		if ln.fd == fd {
+			return ln
+		}
+	}
+	return nil
+}
+
+func (svr *server) closeListeners() {
+	for _, ln := range svr.lns {
+		ln.close()
+	}
+}
+
 func (svr *server) activateReactors(numEventLoop int) error {
 	for i := 0; i < numEventLoop; i++ {
-		if p, err := netpoll.OpenPoller(); err == nil {
+		if p, err := svr.openPoller(); err == nil {
 			el := &eventloop{
 				svr:               svr,
 				codec:             svr.codec,
@@ -53,13 +106,15 @@ func (svr *server) activateReactors(numEventLoop int) error {
 	// Why startReactors before main reactor begin?
 	svr.startReactors()
 
-	if p, err := netpoll.OpenPoller(); err == nil {
+	if p, err := svr.openMainPoller(); err == nil {
 		el := &eventloop{
 			idx:    -1,
 			poller: p,
 			svr:    svr,
 		}
-		_ = el.poller.AddRead(svr.ln.fd)
+		for _, ln := range svr.lns {
+			_ = el.poller.AddRead(ln.fd)
+		}
 		svr.mainLoop = el
 		svr.wg.Add(1)
 		go func() {
@@ -74,7 +129,7 @@ func (svr *server) activateReactors(numEventLoop int) error {
 
 func (svr *server) activateLoops(numEventLoop int) error {
 	for i := 0; i < numEventLoop; i++ {
-		if p, err := netpoll.OpenPoller(); err == nil {
+		if p, err := svr.openPoller(); err == nil {
 			el := &eventloop{
 				svr:               svr,
 				codec:             svr.codec,
@@ -84,7 +139,9 @@ func (svr *server) activateLoops(numEventLoop int) error {
 				eventHandler:      svr.eventHandler,
 				calibrateCallback: svr.subEventLoopSet.calibrate,
 			}
-			_ = el.poller.AddRead(svr.ln.fd)
+			for _, ln := range svr.lns {
+				_ = el.poller.AddRead(ln.fd)
+			}
 			svr.subEventLoopSet.register(el)
 		} else {
 			return err
@@ -94,6 +151,24 @@ func (svr *server) activateLoops(numEventLoop int) error {
 	return nil
 }
 
+// 只有处理连接读写的eventloop才会使用边缘触发，main reactor只负责accept
+func (svr *server) openPoller() (*netpoll.Poller, error) {
+	switch {
+	case svr.opts.IOUring:
+		return netpoll.OpenIOUringPoller()
+	case svr.opts.EdgeTriggered:
+		return netpoll.OpenEdgeTriggeredPoller()
+	}
+	return netpoll.OpenPoller()
+}
+
+func (svr *server) openMainPoller() (*netpoll.Poller, error) {
+	if svr.opts.IOUring {
+		return netpoll.OpenIOUringPoller()
+	}
+	return netpoll.OpenPoller()
+}
+
 func (svr *server) startReactors() {
 	svr.subEventLoopSet.iterate(func(i int, e *eventloop) bool {
 		svr.wg.Add(1)
@@ -116,24 +191,36 @@ func (svr *server) startLoops() {
 	})
 }
 
-func (svr *server) waitForShutdown() {
-	// unlock未lock的锁会fatal error
-	svr.cond.L.Lock()
-	// TODO 会产生死锁
-	svr.cond.Wait()
-	svr.cond.L.Unlock()
+// 把状态推进到to，已经处于to或之后的状态时返回false
+func (svr *server) advance(to int32) bool {
+	for {
+		state := atomic.LoadInt32(&svr.state)
+		if state >= to {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&svr.state, state, to) {
+			return true
+		}
+	}
+}
+
+func (svr *server) inShutdown() bool {
+	return atomic.LoadInt32(&svr.state) >= stateDraining
 }
 
+// 可以在任意goroutine、任意时刻调用多次，包括stop()开始等待之前
 func (svr *server) signalShutdown() {
 	svr.once.Do(func() {
-		svr.cond.L.Lock()
-		svr.cond.Signal()
-		svr.cond.L.Unlock()
+		close(svr.shutdown)
 	})
 }
 
 func (svr *server) stop() {
-	svr.waitForShutdown()
+	<-svr.shutdown
+	svr.advance(stateDraining)
+	// 不再接收新连接，Stop()返回后地址即可被重新使用；stopGracefully开始drain时已经关闭过了。
+	// eventloop在退出之前可能还会读到已经关闭的listener，这时的错误会被忽略
+	svr.closeListeners()
 
 	svr.subEventLoopSet.iterate(func(i int, e *eventloop) bool {
 		sniffErrorAndLog(e.poller.Trigger(func() error {
@@ -143,29 +230,107 @@ func (svr *server) stop() {
 	})
 
 	if svr.mainLoop != nil {
-		svr.ln.close()
 		sniffErrorAndLog(svr.mainLoop.poller.Trigger(func() error {
 			return errServerShutdown
 		}))
 	}
 
 	svr.wg.Wait()
-
+	// eventloop都已经退出，不会再提交新的React
+	svr.reacts.Wait()
 	svr.closeLoops()
+	svr.releaseReactPool()
 
 	if svr.mainLoop != nil {
 		sniffErrorAndLog(svr.mainLoop.poller.Close())
 	}
+	svr.advance(stateStopped)
+}
+
+func (svr *server) stopGracefully(ctx context.Context) error {
+	if !svr.advance(stateDraining) {
+		return ErrServerInShutdown
+	}
+	// drain期间不再接收新连接，新的连接会被拒绝，而不是accept之后马上关闭
+	svr.closeListeners()
+
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		drained, err := svr.drained(ctx)
+		if err != nil || drained {
+			svr.signalShutdown()
+			<-svr.done
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			svr.signalShutdown()
+			<-svr.done
+			return ctx.Err()
+		case <-svr.done:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// 在各个eventloop中检查所有连接的outboundBuffer是否都已经发送完了，
+// 连接只能在所属的eventloop中访问，所以要通过Trigger来检查
+func (svr *server) drained(ctx context.Context) (bool, error) {
+	results := make(chan bool, svr.subEventLoopSet.len())
+	svr.subEventLoopSet.iterate(func(i int, el *eventloop) bool {
+		if err := el.poller.Trigger(func() error {
+			// 已经关闭的连接在io_uring中可能还有数据没发完
+			if el.poller.Draining() {
+				results <- false
+				return nil
+			}
+			for _, c := range el.connections {
+				if c.pendingOutput() || c.reacting() {
+					results <- false
+					return nil
+				}
+			}
+			results <- true
+			return nil
+		}); err != nil {
+			results <- true
+		}
+		return true
+	})
+
+	drained := true
+	for i := svr.subEventLoopSet.len(); i > 0; i-- {
+		select {
+		case ok := <-results:
+			drained = drained && ok
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-svr.done:
+			// server已经因为其他原因退出了
+			return true, nil
+		}
+	}
+	return drained, nil
+}
+
+// 调用时所有React都已经执行完了，它们在eventloop退出后交回的结果被丢弃
+func (svr *server) releaseReactPool() {
+	if svr.reactPool != nil {
+		svr.reactPool.Release()
+	}
 }
 
 func (svr *server) closeLoops() {
 	svr.subEventLoopSet.iterate(func(i int, e *eventloop) bool {
+		e.stopWakeTimer()
 		_ = e.poller.Close()
 		return true
 	})
 }
 
-func serve(eventHandler EventHandler, listener *listener, options *Options) error {
+func startServer(eventHandler EventHandler, lns []*listener, options *Options) (*server, error) {
 	numEventLoop := 1
 	if options.Multicore {
 		numEventLoop = runtime.NumCPU()
@@ -177,7 +342,7 @@ func serve(eventHandler EventHandler, listener *listener, options *Options) erro
 	svr := new(server)
 	svr.eventHandler = eventHandler
 	svr.opts = options
-	svr.ln = listener
+	svr.lns = lns
 
 	switch options.LB {
 	case RoundRobin:
@@ -188,7 +353,9 @@ func serve(eventHandler EventHandler, listener *listener, options *Options) erro
 		svr.subEventLoopSet = new(sourceAddrHashEventLoopSet)
 	}
 
-	svr.cond = sync.NewCond(&sync.Mutex{})
+	svr.state = stateStarting
+	svr.shutdown = make(chan struct{})
+	svr.done = make(chan struct{})
 	svr.ticktock = make(chan time.Duration, 1)
 	svr.logger = func() Logger {
 		if options.Logger == nil {
@@ -207,35 +374,74 @@ func serve(eventHandler EventHandler, listener *listener, options *Options) erro
 	server := Server{
 		svr:          svr,
 		Multicore:    options.Multicore,
-		Addr:         listener.lnaddr,
 		NumEventLoop: numEventLoop,
 		ReusePort:    options.ReusePort,
 		TCPKeepAlive: options.TCPKeepAlive,
 	}
+	for _, ln := range lns {
+		server.Addrs = append(server.Addrs, ln.lnaddr)
+	}
+	if len(lns) > 0 {
+		server.Addr = lns[0].lnaddr
+	}
 	switch svr.eventHandler.OnInitComplete(server) {
 	case None:
 	case Shutdown:
-		return nil
+		// 不启动eventloop，直接视为已经停止
+		svr.closeListeners()
+		svr.advance(stateStopped)
+		close(svr.done)
+		return svr, nil
 	}
-	defer svr.eventHandler.OnShutdown(server)
-
-	shutdown := make(chan os.Signal, 1)
-	signal.Notify(shutdown, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-	defer close(shutdown)
 
-	go func() {
-		if <-shutdown == nil {
-			return
+	if options.AsyncReact {
+		var err error
+		if svr.reactPool, err = goroutine.NewPool(options.ReactPoolSize); err != nil {
+			return nil, err
 		}
-		svr.signalShutdown()
-	}()
+	}
+
+	var sigCh chan os.Signal
+	if !options.DisableSignalNotify {
+		sigCh = make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			if <-sigCh == nil {
+				return
+			}
+			svr.signalShutdown()
+		}()
+	}
 
 	if err := svr.start(numEventLoop); err != nil {
+		if sigCh != nil {
+			signal.Stop(sigCh)
+			close(sigCh)
+		}
 		svr.closeLoops()
+		svr.releaseReactPool()
+		svr.eventHandler.OnShutdown(server)
 		svr.logger.Printf("gnet server is stoping with error: %v\n", err)
-		return err
+		return nil, err
+	}
+	svr.advance(stateRunning)
+	for _, ln := range lns {
+		allServers.Store(ln.protoAddr, svr)
 	}
-	defer svr.stop()
 
-	return nil
+	go func() {
+		svr.stop()
+		for _, ln := range lns {
+			allServers.Delete(ln.protoAddr)
+		}
+		if sigCh != nil {
+			// 先取消监听，否则之后到来的信号会写入已关闭的channel
+			signal.Stop(sigCh)
+			close(sigCh)
+		}
+		svr.eventHandler.OnShutdown(server)
+		close(svr.done)
+	}()
+
+	return svr, nil
 }
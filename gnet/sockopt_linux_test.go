@@ -0,0 +1,95 @@
+package gnet
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type testSockoptServer struct {
+	*EventServer
+	fds chan int
+}
+
+func (s *testSockoptServer) OnOpened(c Conn) (out []byte, action Action) {
+	// 连接关闭之前fd不会被复用
+	s.fds <- c.(*conn).fd
+	return
+}
+
+func TestSocketOptions(t *testing.T) {
+	events := &testSockoptServer{fds: make(chan int, 1)}
+	engine, err := Start(events, "tcp://127.0.0.1:0", WithDisableSignalNotify(true),
+		WithTCPNoDelay(true), WithSocketRecvBuffer(64<<10), WithIPTOS(0x10),
+		WithTCPFastOpen(16), WithListenBacklog(64),
+		WithListeners(
+			// 覆盖Options中的全部选项
+			ListenerConfig{Addr: "tcp://127.0.0.1:0", SocketOptions: &SocketOptions{SocketLinger: -1}},
+			ListenerConfig{Addr: "udp://127.0.0.1:0", SocketOptions: &SocketOptions{ReuseAddr: true}},
+		))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Stop(context.Background())
+	}()
+
+	getInt := func(fd, level, opt int) int {
+		v, err := unix.GetsockoptInt(fd, level, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	lns := engine.svr.lns
+	if v := getInt(lns[2].fd, unix.SOL_SOCKET, unix.SO_REUSEADDR); v == 0 {
+		t.Fatal("SO_REUSEADDR is not set on the UDP listener")
+	}
+	if v := getInt(lns[0].fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN); v != 16 {
+		t.Fatalf("expected TCP_FASTOPEN 16, got %d", v)
+	}
+
+	dial := func(addr net.Addr) int {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		select {
+		case fd := <-events.fds:
+			return fd
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnOpened was not called")
+		}
+		return -1
+	}
+
+	fd := dial(lns[0].lnaddr)
+	if v := getInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY); v == 0 {
+		t.Fatal("TCP_NODELAY is not set")
+	}
+	if v := getInt(fd, unix.IPPROTO_IP, unix.IP_TOS); v != 0x10 {
+		t.Fatalf("expected IP_TOS 0x10, got %#x", v)
+	}
+	// linux上读出的是设置值的两倍
+	if v := getInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF); v < 64<<10 {
+		t.Fatalf("expected SO_RCVBUF >= %d, got %d", 64<<10, v)
+	}
+
+	fd = dial(lns[1].lnaddr)
+	if v := getInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY); v != 0 {
+		t.Fatal("TCP_NODELAY of Options is not overridden by the listener")
+	}
+	l, err := unix.GetsockoptLinger(fd, unix.SOL_SOCKET, unix.SO_LINGER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Onoff == 0 || l.Linger != 0 {
+		t.Fatalf("expected SO_LINGER 0s, got %+v", l)
+	}
+}
@@ -0,0 +1,58 @@
+package gnet
+
+import (
+	"golang_project_note/gnet/internal/netpoll"
+)
+
+// Start、NewClient时检查，不支持的选项返回错误而不是在连接上静默忽略
+func (so *SocketOptions) validate() error {
+	if so.SocketLinger > 0 {
+		return ErrUnsupportedLinger
+	}
+	return nil
+}
+
+// 监听socket上的选项，在bind之前设置，accept的连接在linux上会继承其中的缓冲区大小和TOS。
+// SO_REUSEADDR、backlog和TCP Fast Open由listener.listen处理
+func (so *SocketOptions) setListener(fd int) error {
+	if so.SocketRecvBuffer > 0 {
+		if err := netpoll.SetRecvBuffer(fd, so.SocketRecvBuffer); err != nil {
+			return err
+		}
+	}
+	if so.SocketSendBuffer > 0 {
+		if err := netpoll.SetSendBuffer(fd, so.SocketSendBuffer); err != nil {
+			return err
+		}
+	}
+	if so.IPTOS > 0 {
+		return netpoll.SetTOS(fd, so.IPTOS)
+	}
+	return nil
+}
+
+// 连接上的选项，和TCPKeepAlive一样，设置失败时忽略
+func (so *SocketOptions) setConn(fd int, tcp bool) {
+	if so.SocketRecvBuffer > 0 {
+		_ = netpoll.SetRecvBuffer(fd, so.SocketRecvBuffer)
+	}
+	if so.SocketSendBuffer > 0 {
+		_ = netpoll.SetSendBuffer(fd, so.SocketSendBuffer)
+	}
+	// 只支持关闭时发送RST，大于0的在validate中已经拒绝了
+	if so.SocketLinger < 0 {
+		_ = netpoll.SetLinger(fd, 0)
+	}
+	if !tcp {
+		return
+	}
+	if so.IPTOS > 0 {
+		_ = netpoll.SetTOS(fd, so.IPTOS)
+	}
+	if so.TCPNoDelay {
+		_ = netpoll.SetNoDelay(fd)
+	}
+	if so.TCPQuickAck {
+		_ = netpoll.SetQuickAck(fd)
+	}
+}
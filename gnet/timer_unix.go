@@ -0,0 +1,291 @@
+package gnet
+
+import (
+	"math/bits"
+	"time"
+)
+
+const (
+	// 时间轮的精度
+	wheelTick = time.Millisecond
+	// 每层64个槽，用一个uint64记录哪些槽非空
+	wheelBits  = 6
+	wheelSlots = 1 << wheelBits
+	wheelMask  = wheelSlots - 1
+	// 4层可以覆盖64^4ms（约4.6小时），更远的定时器先放在最高层，到期时再重新插入
+	wheelLevels = 4
+	wheelRange  = 1 << (wheelBits * wheelLevels)
+)
+
+// Timer is returned by Conn.AfterFunc and EventLoop.Schedule, its methods must be called in the event-loop
+// goroutine it belongs to.
+type Timer interface {
+	// Stop prevents the Timer from firing, it returns false if the timer has already fired or been stopped.
+	Stop() bool
+
+	// Reset changes the timer to fire after duration d, it returns true if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// eventloop内部的定时器，只能在所属的eventloop goroutine中使用
+type timer struct {
+	loop *eventloop
+	when time.Time
+	// 到期的tick
+	expires    uint64
+	prev, next *timer
+	// 所在的链表，nil表示没有在等待触发
+	list *timerList
+	f    func() error
+}
+
+func (t *timer) Stop() bool {
+	if t.list == nil {
+		return false
+	}
+	return t.loop.wheel.del(t)
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	if t.loop == nil {
+		// UDP的conn上创建的Timer永远不会触发
+		return false
+	}
+	active := t.Stop()
+	t.loop.addTimer(t, time.Now().Add(d))
+	return active
+}
+
+type timerList struct {
+	head, tail *timer
+	// 所在的层和槽，level为-1表示已经到期的链表
+	level, slot int
+}
+
+func (l *timerList) push(t *timer) {
+	t.list = l
+	t.prev, t.next = l.tail, nil
+	if l.tail == nil {
+		l.head = t
+	} else {
+		l.tail.next = t
+	}
+	l.tail = t
+}
+
+func (l *timerList) remove(t *timer) {
+	if t.prev == nil {
+		l.head = t.next
+	} else {
+		t.prev.next = t.next
+	}
+	if t.next == nil {
+		l.tail = t.prev
+	} else {
+		t.next.prev = t.prev
+	}
+	t.prev, t.next, t.list = nil, nil, nil
+}
+
+// 分层时间轮：第L层的一个槽跨度为64^L个tick，定时器按离到期的距离放入对应的层，
+// 高层的槽到期时把其中的定时器重新插入（降级到低层），添加、删除都是O(1)
+type timingWheel struct {
+	// tick 0对应的时间
+	base time.Time
+	// 已经推进到的tick
+	cur     uint64
+	bitmap  [wheelLevels]uint64
+	slots   [wheelLevels][wheelSlots]timerList
+	expired timerList
+}
+
+func newTimingWheel(now time.Time) *timingWheel {
+	w := &timingWheel{base: now}
+	for level := range w.slots {
+		for slot := range w.slots[level] {
+			w.slots[level][slot] = timerList{level: level, slot: slot}
+		}
+	}
+	w.expired.level = -1
+	return w
+}
+
+// 向上取整，保证定时器不会提前触发
+func (w *timingWheel) tickOf(when time.Time) uint64 {
+	d := when.Sub(w.base)
+	if d <= 0 {
+		return 0
+	}
+	return uint64((d + wheelTick - 1) / wheelTick)
+}
+
+func (w *timingWheel) add(t *timer, when time.Time) {
+	w.del(t)
+	t.when = when
+	t.expires = w.tickOf(when)
+	w.insert(t)
+}
+
+func (w *timingWheel) insert(t *timer) {
+	if t.expires <= w.cur {
+		w.expired.push(t)
+		return
+	}
+	expires := t.expires
+	if expires-w.cur >= wheelRange {
+		expires = w.cur + wheelRange - 1
+	}
+	delta := expires - w.cur
+	level := 0
+	for delta >= 1<<(wheelBits*(level+1)) {
+		level++
+	}
+	slot := int(expires>>(wheelBits*level)) & wheelMask
+	w.slots[level][slot].push(t)
+	w.bitmap[level] |= 1 << uint(slot)
+}
+
+func (w *timingWheel) del(t *timer) bool {
+	l := t.list
+	if l == nil {
+		return false
+	}
+	l.remove(t)
+	if l.level >= 0 && l.head == nil {
+		w.bitmap[l.level] &^= 1 << uint(l.slot)
+	}
+	return true
+}
+
+// 把第level层的slot槽中的定时器全部取出重新插入
+func (w *timingWheel) reinsert(level, slot int) {
+	l := &w.slots[level][slot]
+	w.bitmap[level] &^= 1 << uint(slot)
+	for t := l.head; t != nil; t = l.head {
+		l.remove(t)
+		w.insert(t)
+	}
+}
+
+// 推进到now，到期的定时器移到expired链表
+func (w *timingWheel) advance(now time.Time) {
+	d := now.Sub(w.base)
+	if d <= 0 {
+		return
+	}
+	to := uint64(d / wheelTick)
+	for w.cur < to {
+		// 第0层当前轮剩下的槽都是空的，直接跳到下一轮
+		if w.bitmap[0]>>uint(w.cur&wheelMask+1) == 0 {
+			next := w.cur | wheelMask + 1
+			if next > to {
+				w.cur = to
+				return
+			}
+			w.cur = next
+		} else {
+			w.cur++
+		}
+		if w.cur&wheelMask == 0 {
+			// 低层转完一圈，高层的当前槽降级
+			for level := 1; level < wheelLevels; level++ {
+				slot := int(w.cur>>(wheelBits*level)) & wheelMask
+				w.reinsert(level, slot)
+				if slot != 0 {
+					break
+				}
+			}
+		}
+		w.reinsert(0, int(w.cur&wheelMask))
+	}
+}
+
+// 下一次需要推进时间轮的时间：第0层是最近的到期时间，高层是最近的降级时间
+func (w *timingWheel) next() (time.Time, bool) {
+	if w.expired.head != nil {
+		return w.base.Add(time.Duration(w.cur) * wheelTick), true
+	}
+	var (
+		tick uint64
+		ok   bool
+	)
+	for level := 0; level < wheelLevels; level++ {
+		if w.bitmap[level] == 0 {
+			continue
+		}
+		shift := uint(wheelBits * level)
+		pos := int(w.cur>>shift) & wheelMask
+		// 从当前槽的下一个开始找第一个非空的槽
+		k := uint64(bits.TrailingZeros64(bits.RotateLeft64(w.bitmap[level], -(pos+1))) + 1)
+		next := (w.cur>>shift + k) << shift
+		if !ok || next < tick {
+			tick, ok = next, true
+		}
+	}
+	return w.base.Add(time.Duration(tick) * wheelTick), ok
+}
+
+// 添加定时器，已经在等待时按新的时间重新放置
+func (el *eventloop) addTimer(t *timer, when time.Time) {
+	if el.wheel == nil {
+		el.wheel = newTimingWheel(time.Now())
+	}
+	el.wheel.add(t, when)
+	el.resetWakeTimer()
+}
+
+// 所有定时器共用一个time.Timer，到期时通过Trigger回到eventloop goroutine执行
+func (el *eventloop) resetWakeTimer() {
+	when, ok := el.wheel.next()
+	if !ok {
+		if el.wakeTimer != nil {
+			el.wakeTimer.Stop()
+		}
+		el.wakeAt = time.Time{}
+		return
+	}
+	// 已经安排了更早的唤醒，到时再重新计算
+	if !el.wakeAt.IsZero() && !when.Before(el.wakeAt) {
+		return
+	}
+	el.wakeAt = when
+	if el.wakeTimer == nil {
+		el.wakeTimer = time.AfterFunc(time.Until(when), func() {
+			_ = el.poller.Trigger(el.loopTimers)
+		})
+		return
+	}
+	el.wakeTimer.Reset(time.Until(when))
+}
+
+func (el *eventloop) stopWakeTimer() {
+	if el.wakeTimer != nil {
+		el.wakeTimer.Stop()
+	}
+}
+
+func (el *eventloop) loopTimers() (err error) {
+	el.wakeAt = time.Time{}
+	defer el.resetWakeTimer()
+	el.wheel.advance(time.Now())
+	for t := el.wheel.expired.head; t != nil; t = el.wheel.expired.head {
+		el.wheel.expired.remove(t)
+		if err = t.f(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (el *eventloop) Index() int {
+	return el.idx
+}
+
+func (el *eventloop) Schedule(d time.Duration, fn func()) Timer {
+	t := &timer{loop: el, f: func() error {
+		fn()
+		return nil
+	}}
+	el.addTimer(t, time.Now().Add(d))
+	return t
+}
@@ -0,0 +1,317 @@
+package gnet
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// 解密时明文缓冲区的初始大小，一条TLS记录最多16KB明文
+const tlsPlainBufferSize = 0x10000
+
+// TLS连接的SendFile每次从文件读出的字节数
+const tlsFileChunk = 0x10000
+
+// tlsConn是交给crypto/tls.Conn的底层net.Conn：读的是eventloop收到、还没解密的密文，
+// 写出的密文直接进入conn的发送路径，所以tls.Conn永远不会读写socket。
+// crypto/tls没有非阻塞的握手：Read返回的错误（即使是Temporary的）会被记录为握手的错误，之后再调用Handshake
+// 也只会返回它，数据不足时只能停在Read中，所以每个正在握手的连接有一个goroutine。它和eventloop轮流运行：
+// loopReadTLS收到密文后让握手继续并等待，握手读完密文后交还给eventloop，写出的密文也由eventloop发送，
+// 两者不会同时运行，不需要加锁。握手返回（成功、失败、
+// 连接关闭或者超时）后goroutine就退出了，所以goroutine的数量只和同时在握手的连接数有关。
+// 握手完成后的记录层（解密、加密）都在eventloop中进行，没有密文时Read返回errTLSWouldBlock，不会阻塞
+type tlsConn struct {
+	c    *conn
+	conn *tls.Conn
+	// 握手完成后为true
+	ready bool
+	// 握手完成后的状态，包括ALPN协商的协议和SNI
+	state tls.ConnectionState
+	// 握手完成之前AsyncWrite、AsyncWritev的明文，握手完成后按顺序加密发送
+	early [][]byte
+	// 收到、还没交给tls.Conn的密文，off之前的已经读过
+	in  []byte
+	off int
+	// 对端已经关闭（io.EOF）或者读出错，in中的密文读完后Read返回它
+	rerr error
+	// 连接已经关闭
+	closed bool
+
+	// 握手期间eventloop通过resume让握手继续，握手通过yield交还给eventloop
+	resume chan struct{}
+	yield  chan struct{}
+	// 握手写出、还没发送的密文
+	out []byte
+	// 握手已经返回，以及它返回的错误
+	done bool
+	err  error
+}
+
+// 没有密文可读，tls.Conn遇到Temporary的错误时保留已经读到的部分记录，之后可以继续读
+type tlsWouldBlockError struct{}
+
+func (tlsWouldBlockError) Error() string   { return "tls: no more data in the inbound buffer" }
+func (tlsWouldBlockError) Timeout() bool   { return true }
+func (tlsWouldBlockError) Temporary() bool { return true }
+
+var errTLSWouldBlock net.Error = tlsWouldBlockError{}
+
+func newTLSConn(c *conn, config *tls.Config, client bool) *tlsConn {
+	t := &tlsConn{c: c}
+	if client {
+		t.conn = tls.Client(t, config)
+	} else {
+		t.conn = tls.Server(t, config)
+	}
+	return t
+}
+
+// accept的连接按Options.TLSConfig作为服务端握手
+func (svr *server) acceptTLS(c *conn) {
+	if config := svr.opts.TLSConfig; config != nil {
+		c.tls = newTLSConn(c, config, false)
+	}
+}
+
+// NewClient Dial的连接按Options.TLSConfig作为客户端握手，和tls.Dial一样，没有设置ServerName时使用addr中的主机名
+func (svr *server) dialTLS(c *conn, network, addr string) {
+	config := svr.opts.TLSConfig
+	if config == nil || len(svr.lns) > 0 {
+		// Engine.Dial的连接不使用TLS
+		return
+	}
+	if config.ServerName == "" && network != "unix" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+	c.tls = newTLSConn(c, config, true)
+}
+
+func (t *tlsConn) Read(b []byte) (int, error) {
+	for t.off == len(t.in) {
+		if t.rerr != nil {
+			return 0, t.rerr
+		}
+		if t.closed {
+			return 0, io.EOF
+		}
+		if t.ready {
+			return 0, errTLSWouldBlock
+		}
+		// 握手需要更多密文，交还给eventloop，等下一次loopReadTLS
+		t.yield <- struct{}{}
+		<-t.resume
+	}
+	n := copy(b, t.in[t.off:])
+	if t.off += n; t.off == len(t.in) {
+		t.in, t.off = t.in[:0], 0
+	}
+	return n, nil
+}
+
+func (t *tlsConn) Write(b []byte) (int, error) {
+	if t.closed {
+		return 0, net.ErrClosed
+	}
+	if !t.ready {
+		// 握手写的数据等交还给eventloop后再发送，b在返回后会被tls.Conn复用
+		t.out = append(t.out, b...)
+		return len(b), nil
+	}
+	t.c.send(b)
+	return len(b), nil
+}
+
+// fd由conn关闭，这里什么都不做
+func (t *tlsConn) Close() error                     { return nil }
+func (t *tlsConn) LocalAddr() net.Addr              { return t.c.localAddr }
+func (t *tlsConn) RemoteAddr() net.Addr             { return t.c.remoteAddr }
+func (t *tlsConn) SetDeadline(time.Time) error      { return nil }
+func (t *tlsConn) SetReadDeadline(time.Time) error  { return nil }
+func (t *tlsConn) SetWriteDeadline(time.Time) error { return nil }
+
+// 握手期间对端关闭或者读出错，握手读完剩下的密文后会返回错误，由loopHandshakeDone关闭连接，
+// 握手成功时之后解密读到的EOF再关闭
+func (el *eventloop) loopHandshakeEOF(c *conn, err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+	c.tls.rerr = err
+	return el.loopHandshake(c)
+}
+
+// 连接关闭时调用，还在等密文的握手会读到EOF并返回
+func (t *tlsConn) close() {
+	t.closed = true
+	t.in, t.off = nil, 0
+	t.early = nil
+	if t.resume != nil && !t.done {
+		t.resume <- struct{}{}
+		<-t.yield
+	}
+	t.out = nil
+}
+
+// 还在connect或者TLS握手，OnOpened还没有调用
+func (c *conn) handshaking() bool {
+	return c.tls != nil && !c.tls.ready && !c.tls.closed
+}
+
+// OnOpened之前AsyncWrite、AsyncWritev的数据，TLS连接的明文要等握手完成后加密，其他连接直接放进outboundBuffer
+func (c *conn) writeEarly(buf []byte) {
+	if c.tls != nil {
+		c.tls.early = append(c.tls.early, append([]byte(nil), buf...))
+		return
+	}
+	_, _ = c.outboundBuffer.Write(buf)
+}
+
+// TLS连接不能使用sendfile，读出文件内容加密后和其他数据一样发送
+func (c *conn) sendFileTLS(f *os.File, offset, count int64) error {
+	size := int64(tlsFileChunk)
+	if count < size {
+		size = count
+	}
+	buf := make([]byte, size)
+	for count > 0 {
+		if count < int64(len(buf)) {
+			buf = buf[:count]
+		}
+		n, err := f.ReadAt(buf, offset)
+		if n > 0 {
+			c.write(buf[:n])
+			if !c.opened {
+				return nil
+			}
+		}
+		offset += int64(n)
+		count -= int64(n)
+		if err != nil {
+			if err == io.EOF && count > 0 {
+				// 文件比count短
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) TLSConnectionState() *tls.ConnectionState {
+	if c.tls == nil || !c.tls.ready {
+		return nil
+	}
+	return &c.tls.state
+}
+
+// 开始握手，完成后调用OnOpened。握手期间同样受IdleTimeout、ReadTimeout限制
+func (el *eventloop) startHandshake(c *conn) error {
+	if el.svr.opts.ReadTimeout > 0 || el.svr.opts.WriteTimeout > 0 || el.svr.opts.IdleTimeout > 0 {
+		c.lastRead = time.Now()
+		c.lastWrite = c.lastRead
+	}
+	el.scheduleTimeout(c)
+	t := c.tls
+	t.resume, t.yield = make(chan struct{}), make(chan struct{})
+	go func() {
+		<-t.resume
+		t.err = t.conn.Handshake()
+		t.done = true
+		t.yield <- struct{}{}
+	}()
+	return el.loopHandshake(c)
+}
+
+// 让握手继续运行并等待，直到它读完收到的密文或者返回，然后发送握手写出的密文
+func (el *eventloop) loopHandshake(c *conn) error {
+	t := c.tls
+	t.resume <- struct{}{}
+	<-t.yield
+	if len(t.out) > 0 {
+		c.send(t.out)
+		if t.closed {
+			return nil
+		}
+		t.out = t.out[:0]
+	}
+	if !t.done {
+		return nil
+	}
+	return el.loopHandshakeDone(c, t.err)
+}
+
+func (el *eventloop) loopHandshakeDone(c *conn, err error) error {
+	t := c.tls
+	t.resume, t.yield, t.out = nil, nil, nil
+	if err != nil {
+		return el.loopCloseConn(c, err)
+	}
+	t.ready = true
+	t.state = t.conn.ConnectionState()
+
+	early := t.early
+	t.early = nil
+	for _, buf := range early {
+		c.write(buf)
+		if t.closed {
+			return nil
+		}
+	}
+	if err = el.loopOpen(c); err != nil || !c.opened {
+		return err
+	}
+	// 握手期间可能已经收到了应用数据
+	return el.loopReadTLS(c, nil)
+}
+
+// 把收到的密文交给tls.Conn，解密出的明文和普通连接读到的数据一样交给loopReact，握手期间交给握手继续
+func (el *eventloop) loopReadTLS(c *conn, data []byte) error {
+	t := c.tls
+	t.in = append(t.in, data...)
+	if !t.ready {
+		return el.loopHandshake(c)
+	}
+	if el.tlsBuffer == nil {
+		el.tlsBuffer = make([]byte, tlsPlainBufferSize)
+	}
+	var (
+		n   int
+		err error
+	)
+	for {
+		if n == len(el.tlsBuffer) {
+			el.tlsBuffer = append(el.tlsBuffer, make([]byte, len(el.tlsBuffer))...)
+		}
+		var m int
+		m, err = t.conn.Read(el.tlsBuffer[n:])
+		n += m
+		if err != nil {
+			break
+		}
+	}
+	if t.closed {
+		// 发送alert时出错，连接已经关闭
+		return nil
+	}
+	if n > 0 {
+		c.buffer = el.tlsBuffer[:n]
+		if err := el.loopReact(c); err != nil || !c.opened {
+			return err
+		}
+		if err := el.saveInbound(c); err != nil || !c.opened {
+			return err
+		}
+	}
+	switch err {
+	case errTLSWouldBlock:
+		return nil
+	case io.EOF:
+		// 对端发送了close_notify
+		return el.loopCloseConn(c, nil)
+	}
+	return el.loopCloseConn(c, err)
+}
@@ -3,7 +3,6 @@ module golang_project_note
 go 1.13
 
 require (
-	github.com/libp2p/go-reuseport v0.0.1
 	github.com/stretchr/testify v1.5.1
 	github.com/valyala/bytebufferpool v1.0.0
 	golang.org/x/sys v0.0.0-20200509044756-6aff5f38e54f